@@ -28,12 +28,9 @@ package opl2
 	The generation was based on the MAME implementation but tried to have it use less memory and be faster in general
 	MAME uses much bigger envelope tables and c will be the biggest cause of it sounding different at times
 
-	//TODO Don't delay first operator 1 sample in opl3 mode
 	//TODO Maybe not use class method pointers but a regular function pointers with operator as first parameter
-	//TODO Fix panning for the Percussion channels, would any opl3 player use it and actually really change it though?
 	//TODO Check if having the same accuracy in all frequency multipliers sounds better or not
 
-	//DUNNO Keyon in 4op, switch to 2op without keyoff.
 */
 
 type synthMode uint8
@@ -67,6 +64,8 @@ type Channel struct {
 	fourMask  uint8
 	maskLeft  int8 //Sign extended values for both channel's panning
 	maskRight int8
+	maskC     int8 //Sign extended values for the CHC and CHD outputs of the YMF262
+	maskD     int8
 }
 
 // NewChannel returns a new Channel
@@ -81,15 +80,21 @@ func (c *Channel) SetupChannel() {
 	c.feedback = 31
 	c.maskLeft = -1
 	c.maskRight = -1
+	c.maskC = -1
+	c.maskD = -1
 	c.synthHandler = sm2FM
 	for i := range c.op {
 		c.op[i].SetupOperator()
 	}
 }
 
-// Op gets the operator at index `index`
+// Op gets the operator at index `index`, counting on into the following channels
+// It returns nil when the operator would be past the last channel
 func (c *Channel) Op(chip *Chip, index uint) *Operator {
 	ch := chip.GetChannelByOffset(c, int(index>>1))
+	if ch == nil {
+		return nil
+	}
 	return &ch.op[index&1]
 }
 
@@ -135,7 +140,9 @@ func (c *Channel) UpdateFrequency(chip *Chip, fourOp uint8) {
 	data |= (keyCode << cShiftKeyCode) | (uint32(kslBase) << cShiftKSLBase)
 	c.SetChanData(chip, data)
 	if (fourOp & 0x3f) != 0 {
-		chip.GetChannelByOffset(c, 1).SetChanData(chip, data)
+		if next := chip.GetChannelByOffset(c, 1); next != nil {
+			next.SetChanData(chip, data)
+		}
 	}
 }
 
@@ -170,19 +177,20 @@ func (c *Channel) WriteB0(chip *Chip, val uint8) {
 		return
 	}
 	c.regB0 = val
-	if (val & 0x20) != 0 {
-		c.Op(chip, 0).KeyOn(0x1)
-		c.Op(chip, 1).KeyOn(0x1)
-		if (fourOp & 0x3f) != 0 {
-			chip.GetChannelByOffset(c, 1).Op(chip, 0).KeyOn(1)
-			chip.GetChannelByOffset(c, 1).Op(chip, 1).KeyOn(1)
+	ops := [4]*Operator{c.Op(chip, 0), c.Op(chip, 1)}
+	if (fourOp & 0x3f) != 0 {
+		//The operators of the second channel, missing past the last channel
+		ops[2] = c.Op(chip, 2)
+		ops[3] = c.Op(chip, 3)
+	}
+	for _, o := range ops {
+		if o == nil {
+			continue
 		}
-	} else {
-		c.Op(chip, 0).KeyOff(0x1)
-		c.Op(chip, 1).KeyOff(0x1)
-		if (fourOp & 0x3f) != 0 {
-			chip.GetChannelByOffset(c, 1).Op(chip, 0).KeyOff(1)
-			chip.GetChannelByOffset(c, 1).Op(chip, 1).KeyOff(1)
+		if (val & 0x20) != 0 {
+			o.KeyOn(0x1)
+		} else {
+			o.KeyOff(0x1)
 		}
 	}
 }
@@ -220,6 +228,9 @@ func (c *Channel) WriteC0(chip *Chip, val uint8) {
 				chan0 = chip.GetChannelByOffset(c, -1)
 				chan1 = c
 			}
+			if chan0 == nil || chan1 == nil {
+				return
+			}
 
 			synth := uint8((chan0.regC0&1)<<0) | ((chan1.regC0 & 1) << 1)
 			switch synth {
@@ -251,6 +262,16 @@ func (c *Channel) WriteC0(chip *Chip, val uint8) {
 		} else {
 			c.maskRight = 0
 		}
+		if (val & 0x40) != 0 {
+			c.maskC = -1
+		} else {
+			c.maskC = 0
+		}
+		if (val & 0x80) != 0 {
+			c.maskD = -1
+		} else {
+			c.maskD = 0
+		}
 		//opl2 active
 	} else {
 		//Disable updating percussion channels
@@ -284,9 +305,9 @@ func (c *Channel) GeneratePercussion(chip *Chip, output []int32, opl3Mode bool)
 	if (c.regC0 & 1) != 0 {
 		mod = 0
 	} else {
-		mod = int(c.old[0])
+		mod = int(c.modulatorOutput(chip, opl3Mode))
 	}
-	sample := int32(c.Op(chip, 1).GetSample(mod))
+	bd := int32(c.Op(chip, 1).GetSample(mod))
 
 	//Precalculate stuff used by other outputs
 	noiseBit := uint32(chip.ForwardNoise() & 0x1)
@@ -300,39 +321,64 @@ func (c *Channel) GeneratePercussion(chip *Chip, output []int32, opl3Mode bool)
 	}
 
 	//Hi-Hat
+	var hhsd int32
 	hhVol := c.Op(chip, 2).ForwardVolume()
 	if !envSilent(int(hhVol)) {
 		hhIndex := uint32((phaseBit << 8) | (0x34 << (phaseBit ^ (noiseBit << 1))))
-		sample += int32(c.Op(chip, 2).GetWave(uint(hhIndex), hhVol))
+		hhsd += int32(c.Op(chip, 2).GetWave(uint(hhIndex), hhVol))
 	}
 	//Snare Drum
 	sdVol := c.Op(chip, 3).ForwardVolume()
 	if !envSilent(int(sdVol)) {
 		sdIndex := uint32((0x100 + (c2 & 0x100)) ^ (noiseBit << 8))
-		sample += int32(c.Op(chip, 3).GetWave(uint(sdIndex), sdVol))
+		hhsd += int32(c.Op(chip, 3).GetWave(uint(sdIndex), sdVol))
 	}
 	//Tom-tom
-	sample += int32(c.Op(chip, 4).GetSample(0))
+	tttc := int32(c.Op(chip, 4).GetSample(0))
 
 	//Top-Cymbal
 	tcVol := c.Op(chip, 5).ForwardVolume()
 	if !envSilent(int(tcVol)) {
 		tcIndex := uint32((1 + phaseBit) << 8)
-		sample += int32(c.Op(chip, 5).GetWave(uint(tcIndex), tcVol))
+		tttc += int32(c.Op(chip, 5).GetWave(uint(tcIndex), tcVol))
 	}
-	sample <<= 1
 	if output != nil {
 		if opl3Mode {
-			output[0] += sample
-			output[1] += sample
+			//Each pair of drums is panned by the channel its operators belong to
+			c.mixOutput(output, bd<<1, chip.outputs)
+			chip.GetChannelByOffset(c, 1).mixOutput(output, hhsd<<1, chip.outputs)
+			chip.GetChannelByOffset(c, 2).mixOutput(output, tttc<<1, chip.outputs)
 		} else {
-			output[0] += sample
+			output[0] += (bd + hhsd + tttc) << 1
 		}
 	}
 }
 
+// modulatorOutput returns the output of the first operator used by the rest of the channel
+// It is the output of the previous sample, unless accurate timing is enabled in opl3 mode (see WithAccurateTiming)
+func (c *Channel) modulatorOutput(chip *Chip, opl3Mode bool) int32 {
+	if opl3Mode && chip.accurateTiming {
+		return c.old[1]
+	}
+	return c.old[0]
+}
+
+// mixOutput adds `sample` to the first `outputs` interleaved outputs (2 or 4) enabled for the channel
+func (c *Channel) mixOutput(output []int32, sample int32, outputs uint) {
+	output[0] += sample & int32(c.maskLeft)
+	output[1] += sample & int32(c.maskRight)
+	if outputs == 4 {
+		output[2] += sample & int32(c.maskC)
+		output[3] += sample & int32(c.maskD)
+	}
+}
+
 // BlockTemplate simulates waveform and envelope data from the channel
 func (c *Channel) BlockTemplate(chip *Chip, samples uint32, output []int32, mode synthMode) (int, bool) {
+	//The 4-op and percussion modes use the operators of the following channels
+	if (mode > sm6Start && c.Op(chip, 5) == nil) || (mode > sm4Start && c.Op(chip, 3) == nil) {
+		return 0, false
+	}
 	switch mode {
 	case sm2AM, sm3AM:
 		if c.Op(chip, 0).Silent() && c.Op(chip, 1).Silent() {
@@ -394,7 +440,7 @@ func (c *Channel) BlockTemplate(chip *Chip, samples uint32, output []int32, mode
 		} else if mode == sm3Percussion {
 			var o []int32
 			if output != nil {
-				o = output[i*2:]
+				o = output[i*chip.outputs:]
 			}
 			c.GeneratePercussion(chip, o, true)
 			continue //Prevent some unitialized value bitching
@@ -405,7 +451,7 @@ func (c *Channel) BlockTemplate(chip *Chip, samples uint32, output []int32, mode
 		c.old[0] = c.old[1]
 		c.old[1] = int32(c.Op(chip, 0).GetSample(mod))
 		var sample int32
-		out0 := int(c.old[0])
+		out0 := int(c.modulatorOutput(chip, mode != sm2AM && mode != sm2FM))
 		if mode == sm2AM || mode == sm3AM {
 			sample = int32(out0 + c.Op(chip, 1).GetSample(0))
 		} else if mode == sm2FM || mode == sm3FM {
@@ -434,8 +480,7 @@ func (c *Channel) BlockTemplate(chip *Chip, samples uint32, output []int32, mode
 			case sm2AM, sm2FM:
 				output[i] += sample
 			case sm3AM, sm3FM, sm3FMFM, sm3AMFM, sm3FMAM, sm3AMAM:
-				output[i*2+0] += sample & int32(c.maskLeft)
-				output[i*2+1] += sample & int32(c.maskRight)
+				c.mixOutput(output[i*chip.outputs:], sample, chip.outputs)
 			}
 		}
 	}
@@ -1,6 +1,6 @@
 package opl2
 
-import "time"
+import "github.com/pkg/errors"
 
 // This file is a Pure Go conversion of dbopl.h/.cpp
 
@@ -30,12 +30,9 @@ import "time"
 	The generation was based on the MAME implementation but tried to have it use less memory and be faster in general
 	MAME uses much bigger envelope tables and this will be the biggest cause of it sounding different at times
 
-	//TODO Don't delay first operator 1 sample in opl3 mode
 	//TODO Maybe not use class method pointers but a regular function pointers with operator as first parameter
-	//TODO Fix panning for the Percussion channels, would any opl3 player use it and actually really change it though?
 	//TODO Check if having the same accuracy in all frequency multipliers sounds better or not
 
-	//DUNNO Keyon in 4op, switch to 2op without keyoff.
 */
 
 // Chip is the current state and emulator of the YM3812/YM262 OPL2/3 chip
@@ -58,9 +55,13 @@ type Chip struct {
 	//18 channels with 2 operators each
 	ch [18]Channel
 
+	//Shadow of the last values written to every register
+	regs [512]uint8
+	//Register address latched by the last write to an address port
+	addrLatch uint32
+
 	reg104          uint8
 	reg08           uint8
-	reg04           uint8
 	regBD           uint8
 	vibratoIndex    uint8
 	tremoloIndex    uint8
@@ -74,44 +75,92 @@ type Chip struct {
 	//0 or -1 when enabled
 	opl3Active int8
 
-	isOPL3 int
+	model  Model
+	clock  uint32
+	wave   WaveGenerator
+	output OutputConversion
+	rate   uint32
+	//The first operator is not delayed by a sample in opl3 mode
+	accurateTiming bool
+	//Wave precision (see cWavePrecision) and the shifts of the wave and lfo counters it selects
+	precision uint8
+	waveSh    uint8
+	lfoSh     uint8
+	//Envelopes follow the envelope clock of the real chip, it ticks egAdd >> cEnvClockSh times per sample
+	exactEnvelope bool
+	egClock       uint32
+	egAcc         uint32
+	egAdd         uint32
+
+	//Amount of interleaved outputs written by the OPL3 synth modes, 2 for stereo or 4 for CHA-CHD
+	outputs uint
 
-	status uint8
-	reg02  uint8
-	reg03  uint8
-	timer1 uint8
-	timer2 uint8
+	//Scratch buffers for the float conversion and the mono mixdown of the OPL3 mode
+	floatBuf []int32
+	mixBuf   []int32
 
-	timer1Per uint8
-	timer1Rem uint8
-	timer2Per uint8
-	timer2Rem uint8
+	timers timers
+	onIRQ  IRQHandler
+	//Channels are keyed on by the composite sine wave mode until the next sample
+	cswKeyOn bool
 }
 
-// NewChip creates a new Chip object
-func NewChip(rate uint32, isOPL3 bool) *Chip {
-	c := &Chip{}
-	for i := range c.ch {
-		c.ch[i].SetupChannel()
+// NewChip creates a new Chip object generating samples at `rate` Hz, configured by `opts`
+func NewChip(rate uint32, opts ...ChipOption) (*Chip, error) {
+	cfg := chipConfig{
+		model:  ModelYM3812,
+		wave:   WaveGeneratorTableMul,
+		output: OutputRaw,
+	}
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.validate(rate); err != nil {
+		return nil, err
 	}
 
-	var chipIsOPL3 int
-	if isOPL3 {
-		chipIsOPL3 = -1
-	} else {
-		chipIsOPL3 = 0
+	c := &Chip{
+		model:  cfg.model,
+		clock:  cfg.clock,
+		wave:   cfg.wave,
+		output: cfg.output,
+		rate:   rate,
+		onIRQ:  cfg.onIRQ,
+
+		accurateTiming: cfg.accurateTiming,
+		precision:      cfg.precision,
+		exactEnvelope:  cfg.exactEnvelope,
 	}
-	c.Setup(rate, chipIsOPL3)
-	return c
+	c.setupRates()
+	c.Reset()
+	return c, nil
+}
+
+// GetModel returns the chip model being emulated
+func (c *Chip) GetModel() Model {
+	return c.model
+}
+
+// GetSampleRate returns the output sample rate of the chip
+func (c *Chip) GetSampleRate() uint32 {
+	return c.rate
 }
 
 // GetChannelByOffset returns the channel `ofs` units away from the `ch` channel
+// The offset is applied to the internal order of the channels, where the channels of a 4-op pair follow each other
 func (c *Chip) GetChannelByOffset(ch *Channel, ofs int) *Channel {
-	ci := c.GetChannelIndex(ch)
-	if ci < 0 {
-		return nil
+	for i := range c.ch {
+		if &c.ch[i] != ch {
+			continue
+		}
+		if i+ofs < 0 || i+ofs >= len(c.ch) {
+			return nil
+		}
+		return &c.ch[i+ofs]
 	}
-	return c.GetChannelByIndex(uint32(ci + ofs))
+	return nil
 }
 
 // GetChannelIndex gets the channel index (with skips in-built) for `ch`
@@ -153,8 +202,9 @@ func (c *Chip) GetOperatorByIndex(i uint32) *Operator {
 		chNum += 16 - 12
 	}
 	opNum := (i % 8) / 3
-	if int(chNum) < len(c.ch) {
-		return &c.ch[chNum].op[opNum]
+	//The channel number uses the same layout as the channel registers
+	if ch := c.GetChannelByIndex(chNum); ch != nil {
+		return &ch.op[opNum]
 	}
 	return nil
 }
@@ -162,8 +212,8 @@ func (c *Chip) GetOperatorByIndex(i uint32) *Operator {
 // ForwardNoise updates the noise values and returns the new value
 func (c *Chip) ForwardNoise() uint32 {
 	c.noiseCounter += c.noiseAdd
-	count := uint(c.noiseCounter) >> cLFOSh
-	c.noiseCounter &= cWaveMask
+	count := uint(c.noiseCounter) >> c.lfoSh
+	c.noiseCounter &= (uint32(1) << c.waveSh) - 1
 	for ; count > 0; count-- {
 		//Noise calculation from mame
 		c.noiseValue ^= (0x800302) & (0 - (c.noiseValue & 1))
@@ -183,15 +233,26 @@ func (c *Chip) ForwardLFO(samples uint32) uint32 {
 	c.vibratoShift = uint8(vibVal)&7 + c.vibratoStrength
 	c.tremoloValue = cTremoloTable[c.tremoloIndex] >> c.tremoloStrength
 
+	//Stop at the next timer overflow, so the IRQ is raised at the right sample
+	if n := c.timers.samplesUntilOverflow(); samples > n {
+		samples = n
+	}
+	//The composite sine wave mode keys off one sample after keying on
+	if c.cswKeyOn {
+		samples = 1
+	}
+
 	//Check hom many samples there can be done before the value changes
-	todo := uint32(cLFOMax) - c.lfoCounter
+	//LFO is controlled by our tremolo 256 sample limit
+	lfoMax := uint32(256) << c.lfoSh
+	todo := lfoMax - c.lfoCounter
 	count := (todo + c.lfoAdd - 1) / c.lfoAdd
 	if count > samples {
 		count = samples
 		c.lfoCounter += count * c.lfoAdd
 	} else {
 		c.lfoCounter += count * c.lfoAdd
-		c.lfoCounter &= uint32(cLFOMax) - 1
+		c.lfoCounter &= lfoMax - 1
 		//Maximum of 7 vibrato value * 4
 		c.vibratoIndex = (c.vibratoIndex + 1) & 31
 		//Clip tremolo to the the table size
@@ -202,48 +263,6 @@ func (c *Chip) ForwardLFO(samples uint32) uint32 {
 		}
 	}
 
-	// update timers, if applicable
-	if (c.reg04 & 0x01) != 0 {
-		// timer 1
-		m := count / uint32(c.timer1Per)
-		d := uint8(count % uint32(c.timer1Per))
-		if d >= c.timer1Rem {
-			m++
-			c.timer1Rem = c.timer1Per - d
-		} else {
-			c.timer1Rem -= d
-		}
-
-		if m > 0 {
-			acc := uint32(c.timer1) + m
-			c.timer1 = uint8(acc)
-			c.status |= 0x80 | 0x40 // does this belong here?
-			if acc > 255 && (c.reg04&0x40) == 0 {
-				c.timer1 = c.reg02
-			}
-		}
-	}
-	if (c.reg04 & 0x02) != 0 {
-		// timer 2
-		m := count / uint32(c.timer2Per)
-		d := uint8(count % uint32(c.timer2Per))
-		if d >= c.timer2Rem {
-			m++
-			c.timer2Rem = c.timer2Per - d
-		} else {
-			c.timer2Rem -= d
-		}
-
-		if m > 0 {
-			acc := uint32(c.timer2) + m
-			c.timer2 = uint8(acc)
-			c.status |= 0x80 | 0x20 // does this belong here?
-			if acc > 255 && (c.reg04&0x20) == 0 {
-				c.timer2 = c.reg03
-			}
-		}
-	}
-
 	return count
 }
 
@@ -320,33 +339,63 @@ func (c *Chip) WriteBD(val uint8) {
 }
 
 // ReadStatus returns the value of the status register
+// Bits 7-5 are the IRQ and timer flags, the low bits read as the modelled chip drives them (see Model.StatusBits)
 func (c *Chip) ReadStatus() uint8 {
-	return c.status
+	return c.model.StatusBits() | c.timers.status
+}
+
+// SetOnIRQ sets the function called when a timer overflow raises the IRQ, nil disables the callback
+func (c *Chip) SetOnIRQ(handler IRQHandler) {
+	c.onIRQ = handler
+}
+
+// advanceTimers runs the timers for `samples` samples and calls the IRQ handler on an overflow
+// In CSW mode an overflow of timer 1 also keys on all channels for a single sample
+func (c *Chip) advanceTimers(samples uint32) {
+	if c.cswKeyOn {
+		c.keyCSW(false)
+	}
+	overflowed, irq := c.timers.advance(samples)
+	if (overflowed&statusTimer1) != 0 && (c.reg08&0x80) != 0 && !c.model.isOPL3() {
+		c.keyCSW(true)
+	}
+	if irq && c.onIRQ != nil {
+		c.onIRQ(c.ReadStatus())
+	}
+}
+
+// keyCSW keys the 9 channels of the first bank on or off for the composite sine wave mode
+func (c *Chip) keyCSW(on bool) {
+	c.cswKeyOn = on
+	for i := 0; i < 9; i++ {
+		for j := range c.ch[i].op {
+			if on {
+				c.ch[i].op[j].KeyOn(0x4)
+			} else {
+				c.ch[i].op[j].KeyOff(0x4)
+			}
+		}
+	}
 }
 
 // WriteReg writes to register `reg` with value `val`
 func (c *Chip) WriteReg(reg uint32, val uint8) {
+	//Only the YMF262 decodes the second register bank, this includes the OPL3 enable in register 0x105
+	if reg >= 0x100 && !c.model.isOPL3() {
+		return
+	}
+	c.regs[reg&0x1ff] = val
 	switch (reg & 0xf0) >> 4 {
 	case 0x00 >> 4:
 		if reg == 0x01 {
-			if (val & 0x20) != 0 {
+			//The YM3526 has no waveform select
+			if (val&0x20) != 0 && c.model != ModelYM3526 {
 				c.waveFormMask = 0x7
 			} else {
 				c.waveFormMask = 0x0
 			}
-		} else if reg == 0x02 {
-			//simulate timer updates
-			c.reg02 = val
-		} else if reg == 0x03 {
-			//simulate timer updates
-			c.reg03 = val
-		} else if reg == 0x04 {
-			//simulate timer updates
-			if (val & 0x80) != 0x00 {
-				c.status &^= 0x80 | 0x40 | 0x20
-			} else {
-				c.reg04 = val
-			}
+		} else if reg >= 0x02 && reg <= 0x04 {
+			c.timers.write(reg, val)
 		} else if reg == 0x104 {
 			//Only detect changes in lowest 6 bits
 			if ((c.reg104 ^ val) & 0x3f) == 0 {
@@ -354,6 +403,7 @@ func (c *Chip) WriteReg(reg uint32, val uint8) {
 			}
 			//Always keep the highest bit enabled, for checking > 0x80
 			c.reg104 = 0x80 | (val & 0x3f)
+			c.updateFourOp()
 		} else if reg == 0x105 {
 			//MAME says the real opl3 doesn't reset anything on opl3 disable/enable till the next write in another register
 			if ((uint8(c.opl3Active) ^ val) & 1) == 0 {
@@ -368,6 +418,7 @@ func (c *Chip) WriteReg(reg uint32, val uint8) {
 			for i := 0; i < 18; i++ {
 				c.ch[i].ResetC0(c)
 			}
+			c.updateFourOp()
 		} else if reg == 0x08 {
 			c.reg08 = val
 		}
@@ -428,6 +479,59 @@ func (c *Chip) WriteReg(reg uint32, val uint8) {
 	}
 }
 
+// updateFourOp brings the channel pairs in line with the 4-op selection after a write to 0x104 or 0x105
+// Like on the real chip, the second channel of a pair takes its frequency and key-on from the first channel
+// in 4-op mode and from its own registers in 2-op mode. Operators that stay keyed on are not restarted,
+// the others are keyed on or released, so notes held across the switch neither retrigger nor hang.
+func (c *Chip) updateFourOp() {
+	for bank := uint32(0); bank < 2; bank++ {
+		for _, index := range []uint32{3, 4, 5} {
+			ch := c.GetChannelByIndex(bank<<4 | index)
+			first := c.GetChannelByOffset(ch, -1)
+			fourOp := uint8(c.reg104 & uint8(c.opl3Active) & ch.fourMask)
+
+			var keyOn bool
+			if fourOp > 0x80 {
+				ch.SetChanData(c, first.chanData)
+				keyOn = (first.regB0 & 0x20) != 0
+			} else {
+				//Writes to the channel were dropped in 4-op mode, get them back from the shadow registers
+				reg := bank<<8 | index
+				valA0 := c.regs[0xa0|reg]
+				valB0 := c.regs[0xb0|reg]
+				ch.chanData = (ch.chanData &^ 0xffff) | uint32(valA0) | uint32(valB0&0x1f)<<8
+				ch.UpdateFrequency(c, 0)
+				ch.regB0 = valB0
+				keyOn = (valB0 & 0x20) != 0
+			}
+			for i := range ch.op {
+				if keyOn {
+					ch.op[i].KeyOn(0x1)
+				} else {
+					ch.op[i].KeyOff(0x1)
+				}
+			}
+			first.ResetC0(c)
+			ch.ResetC0(c)
+		}
+	}
+}
+
+// WriteRegChecked is WriteReg, returning an error instead of ignoring writes to unmapped registers
+func (c *Chip) WriteRegChecked(reg uint32, val uint8) error {
+	//The second bank is only mapped in OPL3 mode, apart from the 4-op and OPL3 enables of the YMF262
+	if !registerMapped(reg, c.opl3Active != 0) && !((reg == RegFourOp || reg == RegOPL3) && c.model.isOPL3()) {
+		return &RegisterError{Reg: reg, Err: ErrUnmappedRegister}
+	}
+	c.WriteReg(reg, val)
+	return nil
+}
+
+// ReadReg returns the value last written to register `reg`
+func (c *Chip) ReadReg(reg uint32) uint8 {
+	return c.regs[reg&0x1ff]
+}
+
 // WriteAddr calculates the actual value to be written at a specific port
 func (c *Chip) WriteAddr(port uint32, val uint8) uint32 {
 	switch port & 3 {
@@ -442,93 +546,370 @@ func (c *Chip) WriteAddr(port uint32, val uint8) uint32 {
 	return 0
 }
 
+// WritePort writes `val` to the I/O port `port` (base+0..3, e.g. 0x388-0x38B on an AdLib/Sound Blaster)
+// Writes to the even ports latch a register address, writes to the odd ports store data in the latched register
+// The OPL2 only decodes a single bank, so the addresses written to base+2 are mirrored on bank 0
+func (c *Chip) WritePort(port uint32, val uint8) {
+	if (port & 1) != 0 {
+		c.WriteReg(c.addrLatch, val)
+		return
+	}
+	c.addrLatch = c.WriteAddr(port, val)
+	if !c.model.isOPL3() {
+		c.addrLatch &= 0xff
+	}
+}
+
+// ReadPort reads from the I/O port `port` (base+0..3, e.g. 0x388-0x38B on an AdLib/Sound Blaster)
+// The status register is read from base+0, the other ports are not driven by the chip
+func (c *Chip) ReadPort(port uint32) uint8 {
+	if (port & 3) == 0 {
+		return c.ReadStatus()
+	}
+	return 0xff
+}
+
 // GenerateBlock2 returns sample data for OPL2 output
+// In OPL3 mode the left and right outputs are mixed down to mono
 func (c *Chip) GenerateBlock2(total uint, output []int32) {
-	outputIdx := uint(0)
-	for total > 0 {
-		samples := c.ForwardLFO(uint32(total))
-		count := 0
-		for i := 0; i < 9; {
-			ch := &c.ch[i]
-			count++
-			var o []int32
-			if output != nil {
-				o = output[outputIdx:]
+	if err := c.GenerateBlock2Checked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock2Checked is GenerateBlock2, returning an error instead of panicking
+func (c *Chip) GenerateBlock2Checked(total uint, output []int32) error {
+	if output != nil && uint(len(output)) < total {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", total, len(output))
+	}
+	err := c.generateBlock(total, output, 1)
+	if err == nil && output != nil {
+		c.convertOutput(output[:total])
+	}
+	return err
+}
+
+// GenerateBlock3 returns sample data for OPL3 output (stereo!)
+// In OPL2 mode the mono output is copied to the left and right outputs
+func (c *Chip) GenerateBlock3(total uint, output []int32) {
+	if err := c.GenerateBlock3Checked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock3Checked is GenerateBlock3, returning an error instead of panicking
+func (c *Chip) GenerateBlock3Checked(total uint, output []int32) error {
+	if output != nil && uint(len(output)) < total*2 {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", total, len(output)/2)
+	}
+	err := c.generateBlock(total, output, 2)
+	if err == nil && output != nil {
+		c.convertOutput(output[:total*2])
+	}
+	return err
+}
+
+// GenerateBlock4 returns sample data for the four outputs of the YMF262
+// The output is interleaved as CHA/CHB/CHC/CHD quadruples, CHA and CHB being the left and right outputs
+// of GenerateBlock3. Each channel is routed by bits 4-7 of its C0 register, in OPL2 mode and on the
+// models without a second bank the mono output goes to CHA and CHB only.
+func (c *Chip) GenerateBlock4(total uint, output []int32) {
+	if err := c.GenerateBlock4Checked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock4Checked is GenerateBlock4, returning an error instead of panicking
+func (c *Chip) GenerateBlock4Checked(total uint, output []int32) error {
+	if output != nil && uint(len(output)) < total*4 {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", total, len(output)/4)
+	}
+	err := c.generateBlock(total, output, 4)
+	if err == nil && output != nil {
+		c.convertOutput(output[:total*4])
+	}
+	return err
+}
+
+// convertOutput applies the output conversion of the chip to `output`
+func (c *Chip) convertOutput(output []int32) {
+	if c.output != OutputClip16 {
+		return
+	}
+	for i, s := range output {
+		if s < -0x8000 {
+			output[i] = -0x8000
+		} else if s > 0x7fff {
+			output[i] = 0x7fff
+		}
+	}
+}
+
+// generateBlock renders `total` samples of `outputs` interleaved values (1 for mono, 2 for stereo, 4 for CHA-CHD)
+// The samples overwrite what `output` held before, like on Opal
+// The channels are rendered in the layout of the active mode, then brought to the requested layout:
+// an OPL3 mode block is mixed down for mono, an OPL2 mode block is copied to the left and right outputs
+func (c *Chip) generateBlock(total uint, output []int32, outputs uint) error {
+	channels, stride := 9, uint(1)
+	if c.opl3Active != 0 {
+		channels, stride = 18, outputs
+		if stride == 1 {
+			stride = 2
+		}
+	}
+	if output == nil || stride == outputs {
+		if output != nil {
+			//The channels mix into the output, start from silence
+			for i := range output[:total*outputs] {
+				output[i] = 0
 			}
-			ofs, valid := ch.BlockTemplate(c, samples, o, ch.synthHandler)
-			if !valid {
-				panic("invalid offset returned from BlockTemplate")
+		}
+		return c.renderBlock(total, output, channels, stride)
+	}
+	buf := int32Scratch(&c.mixBuf, total*stride)
+	if err := c.renderBlock(total, buf, channels, stride); err != nil {
+		return err
+	}
+	for i := uint(0); i < total; i++ {
+		if stride == 1 {
+			output[i*outputs+0] = buf[i]
+			output[i*outputs+1] = buf[i]
+			if outputs == 4 {
+				output[i*4+2] = 0
+				output[i*4+3] = 0
 			}
-			i += ofs
+		} else {
+			output[i] = (buf[i*2+0] + buf[i*2+1]) / 2
 		}
-		total -= uint(samples)
-		outputIdx += uint(samples)
 	}
+	return nil
 }
 
-// GenerateBlock3 returns sample data for OPL3 output (stereo!)
-func (c *Chip) GenerateBlock3(total uint, output []int32) {
+// renderBlock runs the first `channels` channels, writing `stride` output values per sample
+func (c *Chip) renderBlock(total uint, output []int32, channels int, stride uint) error {
+	c.outputs = stride
 	outputIdx := uint(0)
 	for total > 0 {
 		samples := c.ForwardLFO(uint32(total))
-		count := 0
-		for i := 0; i < 18; {
+		for i := 0; i < channels; {
 			ch := &c.ch[i]
-			count++
 			var o []int32
 			if output != nil {
 				o = output[outputIdx:]
 			}
 			ofs, valid := ch.BlockTemplate(c, samples, o, ch.synthHandler)
 			if !valid {
-				panic("invalid offset returned from BlockTemplate")
+				return errors.Wrapf(ErrInvalidSynthMode, "channel %d has synth mode %d", i, ch.synthHandler)
 			}
 			i += ofs
 		}
+		c.advanceEnvelopeClock(samples)
+		c.advanceTimers(samples)
 		total -= uint(samples)
-		outputIdx += uint(samples) * 2
+		outputIdx += uint(samples) * stride
 	}
+	return nil
+}
+
+// advanceEnvelopeClock forwards the envelope clock by `samples` samples, as the operators did during the block
+func (c *Chip) advanceEnvelopeClock(samples uint32) {
+	acc := uint64(c.egAcc) + uint64(samples)*uint64(c.egAdd)
+	c.egClock += uint32(acc >> cEnvClockSh)
+	c.egAcc = uint32(acc & cEnvClockMask)
+}
+
+// GenerateBlock2Float returns normalized sample data for OPL2 output (see FloatScale)
+func (c *Chip) GenerateBlock2Float(total uint, output []float32) {
+	if err := c.GenerateBlock2FloatChecked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock2FloatChecked is GenerateBlock2Float, returning an error instead of panicking
+func (c *Chip) GenerateBlock2FloatChecked(total uint, output []float32) error {
+	return generateFloat(total, 1, output, &c.floatBuf, c.GenerateBlock2Checked)
+}
+
+// GenerateBlock3Float returns normalized sample data for OPL3 output (stereo!, see FloatScale)
+func (c *Chip) GenerateBlock3Float(total uint, output []float32) {
+	if err := c.GenerateBlock3FloatChecked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock3FloatChecked is GenerateBlock3Float, returning an error instead of panicking
+func (c *Chip) GenerateBlock3FloatChecked(total uint, output []float32) error {
+	return generateFloat(total, 2, output, &c.floatBuf, c.GenerateBlock3Checked)
+}
+
+// GenerateBlock4Float returns normalized sample data for the four outputs of the YMF262 (see GenerateBlock4 and FloatScale)
+func (c *Chip) GenerateBlock4Float(total uint, output []float32) {
+	if err := c.GenerateBlock4FloatChecked(total, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock4FloatChecked is GenerateBlock4Float, returning an error instead of panicking
+func (c *Chip) GenerateBlock4FloatChecked(total uint, output []float32) error {
+	return generateFloat(total, 4, output, &c.floatBuf, c.GenerateBlock4Checked)
 }
 
 // Setup sets up a chip for correct operation
+// A non-zero `chipIsOPL3` selects the YMF262 model, otherwise the YM3812 model
 func (c *Chip) Setup(rate uint32, chipIsOPL3 int) {
-	original := float64(OPLRATE)
-	scale := original / float64(rate)
+	if chipIsOPL3 != 0 {
+		c.model = ModelYMF262
+	} else {
+		c.model = ModelYM3812
+	}
+	c.clock = c.model.DefaultClock()
+	if c.wave == 0 {
+		c.wave = cDBOPLWave
+	}
+	c.rate = rate
+	c.setupRates()
+	c.Reset()
+}
 
-	c.isOPL3 = chipIsOPL3
+// SetSampleRate changes the output sample rate of the chip
+// Only the rate-derived data is recalculated, so the register state and sounding voices are kept
+// The rate is validated like in NewChip, the chip is left unchanged when it is not supported
+func (c *Chip) SetSampleRate(rate uint32) error {
+	cfg := c.config()
+	if err := cfg.validate(rate); err != nil {
+		return err
+	}
+	c.rate = rate
+	c.updateRates()
+	return nil
+}
 
-	if chipIsOPL3 == 0 {
-		c.status = 0x06 // randomish data that some systems use to detect OPL2 vs OPL3
+// SetClock changes the master clock of the chip in Hz, 0 selects the nominal clock of the model
+// Pitch, envelope rates, LFO speed and timer periods all scale with the clock
+// The clock is validated like in NewChip, the chip is left unchanged when it is not supported
+func (c *Chip) SetClock(clock uint32) error {
+	cfg := c.config()
+	cfg.clock = clock
+	if err := cfg.validate(c.rate); err != nil {
+		return err
 	}
+	c.clock = cfg.clock
+	c.updateRates()
+	return nil
+}
 
-	//Noise counter is run at the same precision as general waves
-	c.noiseAdd = uint32(0.5 + scale*float64(uint32(1)<<cLFOSh))
-	c.noiseCounter = 0
-	c.noiseValue = 1 //Make sure it triggers the noise xor the first time
-	//The low frequency oscillation counter
-	//Every time his overflows vibrato and tremoloindex are increased
-	c.lfoAdd = uint32(0.5 + scale*float64(uint32(1)<<cLFOSh))
-	c.lfoCounter = 0
-	c.vibratoIndex = 0
-	c.tremoloIndex = 0
-	c.timer1Per = uint8(0.5 + (time.Microsecond*80).Seconds()*float64(rate))
-	c.timer1Rem = c.timer1Per
-	c.timer2Per = uint8(0.5 + (time.Microsecond*320).Seconds()*float64(rate))
-	c.timer2Rem = c.timer2Per
+// config returns the options the chip is currently configured with
+func (c *Chip) config() chipConfig {
+	return chipConfig{
+		model:  c.model,
+		wave:   c.wave,
+		clock:  c.clock,
+		output: c.output,
+		onIRQ:  c.onIRQ,
+
+		accurateTiming: c.accurateTiming,
+		precision:      c.precision,
+		exactEnvelope:  c.exactEnvelope,
+	}
+}
+
+// updateRates recalculates the rate-derived data and forwards it to the operators
+func (c *Chip) updateRates() {
+	c.setupRates()
+	for i := range c.ch {
+		for j := range c.ch[i].op {
+			o := &c.ch[i].op[j]
+			o.freqMul = c.freqMul[o.reg20&0xf]
+			o.UpdateFrequency()
+			o.UpdateAttack(c)
+			o.UpdateDecay(c)
+			o.UpdateRelease(c)
+		}
+	}
+}
+
+// SetAccurateTiming selects whether the first operator is delayed by a sample in opl3 mode, see WithAccurateTiming
+func (c *Chip) SetAccurateTiming(enabled bool) error {
+	cfg := c.config()
+	cfg.accurateTiming = enabled
+	if err := cfg.validate(c.rate); err != nil {
+		return err
+	}
+	c.accurateTiming = enabled
+	return nil
+}
+
+// SetExactEnvelope selects the exact envelope mode, see WithExactEnvelope
+func (c *Chip) SetExactEnvelope(enabled bool) {
+	c.exactEnvelope = enabled
+	for i := range c.ch {
+		for j := range c.ch[i].op {
+			c.ch[i].op[j].SetExactEnvelope(enabled)
+		}
+	}
+}
+
+// GetClock returns the master clock of the chip in Hz
+func (c *Chip) GetClock() uint32 {
+	return c.clock
+}
 
+// rateScale returns the amount of internal samples of `model` running at `clock` Hz per output sample at `rate` Hz
+func rateScale(model Model, clock, rate uint32) float64 {
+	//The internal sample rate is OPLRATE at the nominal clock
+	original := float64(OPLRATE) * float64(clock) / float64(model.DefaultClock())
+	return original / float64(rate)
+}
+
+// minRateScale is the smallest supported ratio of the internal sample rate to the output rate
+// Below it the envelope and LFO steps lose their precision and round towards 0, and fitting the
+// attack rates simulates ever longer envelopes until setupRates no longer finishes in reasonable time
+const minRateScale = 1.0 / 8
+
+// checkRateScale fails with ErrUnsupportedOption when `clock` is too slow for the output rate `rate`
+func checkRateScale(model Model, clock, rate uint32) error {
+	if rateScale(model, clock, rate) < minRateScale {
+		return errors.Wrapf(ErrUnsupportedOption, "%d Hz clock at %d Hz", clock, rate)
+	}
+	return nil
+}
+
+// freqMulTable returns the frequency multipliers of the wave precision `precision` for the rate scale `scale`
+func freqMulTable(precision uint8, scale float64) (freqMul [16]uint32) {
+	waveSh := waveShift(precision)
 	//With higher octave this gets shifted up
 	//-1 since the freqCreateTable = *2
-	if cWavePrecision != 0 {
-		freqScale := float64(float64(1<<7) * scale * float64(uint(1)<<(cWaveSh-1-10)))
+	if precision != 0 {
+		freqScale := float64(float64(1<<7) * scale * float64(uint(1)<<(waveSh-1-10)))
 		for i := 0; i < 16; i++ {
-			c.freqMul[i] = uint32(0.5 + freqScale*float64(cFreqCreateTable[i]))
+			freqMul[i] = uint32(0.5 + freqScale*float64(cFreqCreateTable[i]))
 		}
 	} else {
-		freqScale := uint32(0.5 + scale*float64(uint(1)<<(cWaveSh-1-10)))
+		freqScale := uint32(0.5 + scale*float64(uint(1)<<(waveSh-1-10)))
 		for i := 0; i < 16; i++ {
-			c.freqMul[i] = freqScale * cFreqCreateTable[i]
+			freqMul[i] = freqScale * cFreqCreateTable[i]
 		}
 	}
+	return
+}
+
+// setupRates calculates the tables and counters that depend on the sample rate and clock of the chip
+func (c *Chip) setupRates() {
+	rate := c.rate
+	scale := rateScale(c.model, c.clock, rate)
+	c.waveSh = waveShift(c.precision)
+	c.lfoSh = lfoShift(c.precision)
+
+	//Noise counter is run at the same precision as general waves
+	c.noiseAdd = uint32(0.5 + scale*float64(uint32(1)<<c.lfoSh))
+	//The low frequency oscillation counter
+	//Every time his overflows vibrato and tremoloindex are increased
+	c.lfoAdd = uint32(0.5 + scale*float64(uint32(1)<<c.lfoSh))
+	c.timers.setRate(rate, c.clock, c.model.DefaultClock())
+	//The envelope clock ticks once per sample at the internal sample rate
+	c.egAdd = uint32(0.5 + scale*float64(uint32(1)<<cEnvClockSh))
+
+	c.freqMul = freqMulTable(c.precision, scale)
 
 	//-3 since the real envelope takes 8 steps to reach the single value we supply
 	for i := uint8(0); i < 76; i++ {
@@ -565,9 +946,10 @@ func (c *Chip) Setup(rate uint32, chipIsOPL3 int) {
 			}
 			//Init last on first pass
 			if lDiff < bestDiff {
-				bestDiff := lDiff
+				bestDiff = lDiff
 				bestAdd = guessAdd
-				if bestDiff != 0 {
+				//We hit an exactly matching sample count
+				if bestDiff == 0 {
 					break
 				}
 			}
@@ -589,6 +971,42 @@ func (c *Chip) Setup(rate uint32, chipIsOPL3 int) {
 		//This should provide instant volume maximizing
 		c.attackRates[i] = uint32(8) << cRateSh
 	}
+}
+
+// Reset returns the chip to its power-on state, keeping the current sample rate
+func (c *Chip) Reset() {
+	*c = Chip{
+		model:          c.model,
+		clock:          c.clock,
+		wave:           c.wave,
+		output:         c.output,
+		rate:           c.rate,
+		accurateTiming: c.accurateTiming,
+		precision:      c.precision,
+		waveSh:         c.waveSh,
+		lfoSh:          c.lfoSh,
+		exactEnvelope:  c.exactEnvelope,
+		egAdd:          c.egAdd,
+		floatBuf:       c.floatBuf,
+		noiseAdd:       c.noiseAdd,
+		lfoAdd:         c.lfoAdd,
+		freqMul:        c.freqMul,
+		linearRates:    c.linearRates,
+		attackRates:    c.attackRates,
+		timers:         c.timers,
+		onIRQ:          c.onIRQ,
+	}
+	c.timers.reset()
+	for i := range c.ch {
+		c.ch[i].SetupChannel()
+		for j := range c.ch[i].op {
+			c.ch[i].op[j].SetPrecision(c.precision)
+			c.ch[i].op[j].SetExactEnvelope(c.exactEnvelope)
+		}
+	}
+
+	c.noiseValue = 1 //Make sure it triggers the noise xor the first time
+
 	//Setup the channels with the correct four op flags
 	//Channels are accessed through a table so they appear linear here
 	c.ch[0].fourMask = 0x00 | (1 << 0)
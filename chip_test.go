@@ -0,0 +1,582 @@
+package opl2_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/gotracker/opl2"
+	"github.com/pkg/errors"
+)
+
+func newChip(t *testing.T, model opl2.Model, opts ...opl2.ChipOption) *opl2.Chip {
+	t.Helper()
+	c, err := opl2.NewChip(uint32(opl2.OPL3SampleRate), append([]opl2.ChipOption{opl2.WithModel(model)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func isSilent(data []int32) bool {
+	for _, s := range data {
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChipSetSampleRateKeepsVoices(t *testing.T) {
+	c := newChip(t, opl2.ModelYM3812)
+	playTone(c, 0x00)
+
+	out := make([]int32, 1024)
+	c.GenerateBlock2(uint(len(out)), out)
+	if isSilent(out) {
+		t.Fatal("expected a non-silent output before the rate change")
+	}
+
+	if err := c.SetSampleRate(22050); err != nil {
+		t.Fatal(err)
+	}
+	if rate := c.GetSampleRate(); rate != 22050 {
+		t.Fatalf("expected a sample rate of 22050, got %d", rate)
+	}
+	out = make([]int32, 1024)
+	c.GenerateBlock2(uint(len(out)), out)
+	if isSilent(out) {
+		t.Error("expected a non-silent output after the rate change")
+	}
+}
+
+func TestChipSetSampleRateInvalid(t *testing.T) {
+	c := newChip(t, opl2.ModelYM3812)
+	playTone(c, 0x00)
+
+	if err := c.SetSampleRate(0); !errors.Is(err, opl2.ErrInvalidSampleRate) {
+		t.Fatalf("expected an invalid sample rate error, got %v", err)
+	}
+	if rate := c.GetSampleRate(); rate != uint32(opl2.OPL3SampleRate) {
+		t.Fatalf("expected the sample rate to be kept, got %d", rate)
+	}
+	out := make([]int32, 1024)
+	c.GenerateBlock2(uint(len(out)), out)
+	if isSilent(out) {
+		t.Error("expected a non-silent output after the rejected rate change")
+	}
+}
+
+func TestChipReset(t *testing.T) {
+	c := newChip(t, opl2.ModelYM3812)
+	playTone(c, 0x00)
+	c.GenerateBlock2(1024, nil)
+
+	c.Reset()
+	if rate := c.GetSampleRate(); rate != uint32(opl2.OPL3SampleRate) {
+		t.Fatalf("expected the sample rate to be kept, got %d", rate)
+	}
+	out := make([]int32, 1024)
+	c.GenerateBlock2(uint(len(out)), out)
+	if !isSilent(out) {
+		t.Error("expected a silent output after reset")
+	}
+}
+
+func TestChipPortIO(t *testing.T) {
+	const base = 0x388
+
+	c := newChip(t, opl2.ModelYMF262)
+	sequence := [][2]uint8{
+		{0, 0xA0}, {1, 0x55},
+		{2, 0x05}, {3, 0x01},
+		{2, 0xA0}, {3, 0x77},
+		{0, 0xB0}, {1, 0x12},
+	}
+	for _, w := range sequence {
+		c.WritePort(base+uint32(w[0]), w[1])
+	}
+	for reg, expected := range map[uint32]uint8{0xA0: 0x55, 0x105: 0x01, 0x1A0: 0x77, 0xB0: 0x12} {
+		if val := c.ReadReg(reg); val != expected {
+			t.Errorf("register %0.3X: expected %0.2X, got %0.2X", reg, expected, val)
+		}
+	}
+
+	if status := c.ReadPort(base); status != c.ReadStatus() {
+		t.Errorf("expected the status %0.2X on the address port, got %0.2X", c.ReadStatus(), status)
+	}
+	if val := c.ReadPort(base + 1); val != 0xFF {
+		t.Errorf("expected FF from the data port, got %0.2X", val)
+	}
+
+	// the OPL2 mirrors the second bank onto the first
+	c2 := newChip(t, opl2.ModelYM3812)
+	c2.WritePort(base+2, 0xA3)
+	c2.WritePort(base+3, 0x66)
+	if val := c2.ReadReg(0xA3); val != 0x66 {
+		t.Errorf("expected the OPL2 to write register A3, got %0.2X", val)
+	}
+}
+
+func TestNewChipOptions(t *testing.T) {
+	if _, err := opl2.NewChip(0); !errors.Is(err, opl2.ErrInvalidSampleRate) {
+		t.Errorf("expected an invalid sample rate error, got %v", err)
+	}
+	if _, err := opl2.NewChip(44100, opl2.WithModel(opl2.Model(42))); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected an unsupported option error, got %v", err)
+	}
+	for name, opts := range map[string][]opl2.ChipOption{
+		"accurate timing on the YM3526":                {opl2.WithModel(opl2.ModelYM3526), opl2.WithAccurateTiming(true)},
+		"accurate timing on the YM3812":                {opl2.WithModel(opl2.ModelYM3812), opl2.WithAccurateTiming(true)},
+		"high precision with a 4x clock":               {opl2.WithHighPrecision(true), opl2.WithClock(4 * opl2.ModelYM3812.DefaultClock())},
+		"high precision with a 4x clock on the YMF262": {opl2.WithModel(opl2.ModelYMF262), opl2.WithClock(4 * opl2.ModelYMF262.DefaultClock()), opl2.WithHighPrecision(true)},
+	} {
+		if _, err := opl2.NewChip(11025, opts...); !errors.Is(err, opl2.ErrUnsupportedOption) {
+			t.Errorf("%s: expected an unsupported option error, got %v", name, err)
+		}
+	}
+	opl2Chip := newChip(t, opl2.ModelYM3812)
+	if err := opl2Chip.SetAccurateTiming(true); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected accurate timing to be rejected on the YM3812, got %v", err)
+	}
+
+	c, err := opl2.NewChip(44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model := c.GetModel(); model != opl2.ModelYM3812 {
+		t.Errorf("expected the default model to be the YM3812, got %v", model)
+	}
+
+	// the same tone on all channels goes past the 16-bit range
+	for _, conversion := range []opl2.OutputConversion{opl2.OutputRaw, opl2.OutputClip16} {
+		loud := newChip(t, opl2.ModelYM3812, opl2.WithOutputConversion(conversion))
+		for ch := uint32(0); ch < 9; ch++ {
+			op := ch%3 + ch/3*8
+			loud.WriteReg(0x23+op, 0x21)
+			loud.WriteReg(0x40+op, 0x3F)
+			loud.WriteReg(0x43+op, 0x00)
+			loud.WriteReg(0x63+op, 0xF0)
+			loud.WriteReg(0x83+op, 0x0F)
+			loud.WriteReg(0xA0+ch, 0x98)
+		}
+		for ch := uint32(0); ch < 9; ch++ {
+			loud.WriteReg(0xB0+ch, 0x31)
+		}
+		out := make([]int32, 1024)
+		loud.GenerateBlock2(uint(len(out)), out)
+		var peak int32
+		for _, s := range out {
+			if s > peak {
+				peak = s
+			}
+		}
+		if clipped := peak <= 0x7fff; clipped != (conversion == opl2.OutputClip16) {
+			t.Errorf("output conversion %d: unexpected peak of %d", conversion, peak)
+		}
+	}
+}
+
+func TestChipSetupModel(t *testing.T) {
+	var c opl2.Chip
+	c.Setup(44100, 0)
+	if model := c.GetModel(); model != opl2.ModelYM3812 {
+		t.Errorf("expected Setup to select the YM3812, got %v", model)
+	}
+	c.Setup(44100, -1)
+	if model := c.GetModel(); model != opl2.ModelYMF262 {
+		t.Errorf("expected Setup to select the YMF262, got %v", model)
+	}
+}
+
+func TestChipOPL2IgnoresSecondBank(t *testing.T) {
+	const count = 256
+	expected := make([]int32, count)
+	ref := newChip(t, opl2.ModelYM3812)
+	playTone(ref, 0x11)
+	ref.GenerateBlock2(count, expected)
+
+	c := newChip(t, opl2.ModelYM3812)
+	c.WriteReg(0x105, 0x01)
+	c.WriteReg(0x1A0, 0x42)
+	playTone(c, 0x11)
+	out := make([]int32, count)
+	c.GenerateBlock2(count, out)
+
+	for _, reg := range []uint32{0x105, 0x1A0} {
+		if val := c.ReadReg(reg); val != 0 {
+			t.Errorf("expected register %0.3X to be ignored, got %0.2X", reg, val)
+		}
+	}
+	for i := range out {
+		if out[i] != expected[i] {
+			t.Fatalf("expected the OPL3 enable to be ignored, sample %d is %d instead of %d", i, out[i], expected[i])
+		}
+	}
+}
+
+func TestChipFourOutputs(t *testing.T) {
+	c := newChip(t, opl2.ModelYMF262)
+	c.WriteReg(0x105, 0x01)
+	playTone(c, 0x40) // CHC only
+
+	const count = 1024
+	out := make([]int32, count*4)
+	c.GenerateBlock4(count, out)
+
+	var active [4]bool
+	for i, s := range out {
+		active[i%4] = active[i%4] || s != 0
+	}
+	if active != [4]bool{false, false, true, false} {
+		t.Errorf("expected output on CHC only, got %v", active)
+	}
+}
+
+func TestChipMonoInOPL3Mode(t *testing.T) {
+	c := newChip(t, opl2.ModelYMF262)
+	c.WriteReg(0x105, 0x01)
+	playTone(c, 0x10) // left only
+
+	const count = 64
+	out := make([]int32, count)
+	c.GenerateBlock2(count, out)
+	if isSilent(out) {
+		t.Error("expected the left channel in the mono output")
+	}
+	if err := c.GenerateBlock2Checked(count, make([]int32, count)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChipLastChannelOfBank(t *testing.T) {
+	c := newChip(t, opl2.ModelYMF262)
+	c.WriteReg(0x105, 0x01)
+	c.WriteReg(0x104, 0x3F)
+	for _, bank := range []uint32{0x000, 0x100} {
+		for _, op := range []uint32{0x12, 0x15} {
+			c.WriteReg(bank|(0x20+op), 0x21)
+			c.WriteReg(bank|(0x40+op), 0x00)
+			c.WriteReg(bank|(0x60+op), 0xF0)
+			c.WriteReg(bank|(0x80+op), 0x0F)
+		}
+		c.WriteReg(bank|0xC8, 0x31)
+		c.WriteReg(bank|0xA8, 0x98)
+		c.WriteReg(bank|0xB8, 0x31)
+	}
+
+	out := make([]int32, 1024*2)
+	if err := c.GenerateBlock3Checked(1024, out); err != nil {
+		t.Fatal(err)
+	}
+	if isSilent(out) {
+		t.Error("expected the last channels of the banks to play")
+	}
+
+	last := c.GetChannelByIndex(0x18)
+	if last.Op(c, 1) == nil {
+		t.Error("expected the operators of the last channel")
+	}
+	if o := last.Op(c, 2); o != nil {
+		t.Errorf("expected no operator past the last channel, got %p", o)
+	}
+}
+
+func TestChipAccurateTiming(t *testing.T) {
+	render := func(opl3, accurate bool) []int32 {
+		c := newChip(t, opl2.ModelYMF262, opl2.WithAccurateTiming(accurate))
+		if opl3 {
+			c.WriteReg(0x105, 0x01)
+		}
+		playTone(c, 0x30)
+		c.WriteReg(0x40, 0x10) // modulator: audible modulation
+		out := make([]int32, 1024*2)
+		c.GenerateBlock3(1024, out)
+		return out
+	}
+	same := func(a, b []int32) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if same(render(true, false), render(true, true)) {
+		t.Error("expected accurate timing to change the opl3 output")
+	}
+	if !same(render(false, false), render(false, true)) {
+		t.Error("expected accurate timing to leave the opl2 output alone")
+	}
+}
+
+func TestChipWaveGenerators(t *testing.T) {
+	render := func(wave opl2.WaveGenerator, waveForm uint8) []int32 {
+		c := newChip(t, opl2.ModelYM3812, opl2.WithWaveGenerator(wave))
+		c.WriteReg(0x01, 0x20)
+		c.WriteReg(0xE3, waveForm)
+		playTone(c, 0x00)
+		out := make([]int32, 2048)
+		c.GenerateBlock2(uint(len(out)), out)
+		return out
+	}
+	peak := func(data []int32) (min, max int32) {
+		for _, s := range data {
+			if s < min {
+				min = s
+			}
+			if s > max {
+				max = s
+			}
+		}
+		return
+	}
+
+	_, reference := peak(render(opl2.WaveGeneratorTableMul, 0))
+	for name, wave := range map[string]opl2.WaveGenerator{
+		"Handler":  opl2.WaveGeneratorHandler,
+		"TableLog": opl2.WaveGeneratorTableLog,
+		"TableMul": opl2.WaveGeneratorTableMul,
+	} {
+		if _, max := peak(render(wave, 0)); max < reference*95/100 || max > reference*105/100 {
+			t.Errorf("%s: expected a peak close to %d, got %d", name, reference, max)
+		}
+	}
+
+	// a chip set up without NewChip uses the default wave generator
+	var c opl2.Chip
+	c.Setup(44100, 0)
+	playTone(&c, 0x00)
+	out := make([]int32, 2048)
+	c.GenerateBlock2(uint(len(out)), out)
+	if _, max := peak(out); max < reference*95/100 || max > reference*105/100 {
+		t.Errorf("Setup: expected a peak close to %d, got %d", reference, max)
+	}
+
+	if _, err := opl2.NewChip(44100, opl2.WithWaveGenerator(opl2.WaveGenerator(0))); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected an unsupported option error, got %v", err)
+	}
+}
+
+func TestChipWaveforms(t *testing.T) {
+	render := func(wave opl2.WaveGenerator, waveForm uint8) []int32 {
+		c := newChip(t, opl2.ModelYMF262, opl2.WithWaveGenerator(wave))
+		c.WriteReg(0x105, 0x01)
+		c.WriteReg(0xE3, waveForm)
+		playTone(c, 0x10)
+		out := make([]int32, 2048*2)
+		c.GenerateBlock3(uint(len(out)/2), out)
+		left := make([]int32, len(out)/2)
+		for i := range left {
+			left[i] = out[i*2]
+		}
+		return left
+	}
+	// mismatches counts the samples that differ by more than 5% of the full scale,
+	// the edges of the square waves are allowed to move by a sample between the generators
+	mismatches := func(a, b []int32) int {
+		count := 0
+		for i := range a {
+			if diff := a[i] - b[i]; diff < -200 || diff > 200 {
+				count++
+			}
+		}
+		return count
+	}
+
+	sine := render(opl2.WaveGeneratorTableMul, 0)
+	for waveForm := uint8(1); waveForm < 8; waveForm++ {
+		reference := render(opl2.WaveGeneratorTableMul, waveForm)
+		if mismatches(reference, sine) < len(sine)/4 {
+			t.Errorf("expected waveform %d to replace the sine", waveForm)
+		}
+		for name, wave := range map[string]opl2.WaveGenerator{
+			"Handler":  opl2.WaveGeneratorHandler,
+			"TableLog": opl2.WaveGeneratorTableLog,
+		} {
+			if count := mismatches(render(wave, waveForm), reference); count > len(reference)/50 {
+				t.Errorf("%s: expected waveform %d to match the multiplication table, %d samples differ", name, waveForm, count)
+			}
+		}
+	}
+}
+
+// toneFrequency measures the frequency of `out` at `rate` Hz between the first and the last rising zero crossing,
+// interpolated between the samples
+func toneFrequency(out []int32, rate float64) float64 {
+	var first, last float64
+	periods := -1
+	for j := 1; j < len(out); j++ {
+		if out[j-1] < 0 && out[j] >= 0 {
+			at := float64(j-1) + float64(-out[j-1])/float64(out[j]-out[j-1])
+			if periods < 0 {
+				first = at
+			}
+			last = at
+			periods++
+		}
+	}
+	return float64(periods) * rate / (last - first)
+}
+
+func TestChipHighPrecision(t *testing.T) {
+	const rate = 11025
+	// F-number 0x198 in block 4 plays at 408 * 49716 / 2^16 Hz
+	expected := 408 * opl2.OPLRATE / (1 << 16)
+	var freqErr [2]float64
+	for i, precise := range []bool{false, true} {
+		c, err := opl2.NewChip(rate, opl2.WithHighPrecision(precise))
+		if err != nil {
+			t.Fatal(err)
+		}
+		playTone(c, 0x00)
+		out := make([]int32, rate*20)
+		c.GenerateBlock2(uint(len(out)), out)
+		freq := toneFrequency(out, rate)
+		freqErr[i] = math.Abs(freq-expected) / expected
+		if freqErr[i] > 1e-4 {
+			t.Errorf("high precision %v: expected a frequency of %f Hz, got %f Hz", precise, expected, freq)
+		}
+	}
+	if freqErr[1]*4 > freqErr[0] {
+		t.Errorf("expected the high precision mode to reduce the frequency error, got %g and %g", freqErr[1], freqErr[0])
+	}
+}
+
+func TestChipHighPrecisionLowRate(t *testing.T) {
+	const rate = 8000
+	c, err := opl2.NewChip(rate, opl2.WithHighPrecision(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the highest F-number and multiplier take the most headroom
+	playTone(c, 0x00)
+	c.WriteReg(0x23, 0x2F)
+	c.WriteReg(0xA0, 0xFF)
+	c.WriteReg(0xB0, 0x23) // key on, block 0
+	out := make([]int32, rate*4)
+	c.GenerateBlock2(uint(len(out)), out)
+	expected := 1023 * 15 * opl2.OPLRATE / (1 << 20)
+	if freq := toneFrequency(out, rate); math.Abs(freq-expected)/expected > 1e-3 {
+		t.Errorf("expected a frequency of %f Hz, got %f Hz", expected, freq)
+	}
+
+	if _, err := opl2.NewChip(5000, opl2.WithHighPrecision(true)); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected high precision at 5000 Hz to be rejected, got %v", err)
+	}
+	if err := c.SetSampleRate(5000); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected a rate change to 5000 Hz to be rejected, got %v", err)
+	}
+	if err := c.SetClock(2 * opl2.ModelYM3812.DefaultClock()); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected twice the clock to be rejected, got %v", err)
+	}
+	if c.GetSampleRate() != rate || c.GetClock() != opl2.ModelYM3812.DefaultClock() {
+		t.Errorf("expected the rejected changes to leave the chip alone, got %d Hz with a %d Hz clock", c.GetSampleRate(), c.GetClock())
+	}
+}
+
+func TestChipOperatorRouting(t *testing.T) {
+	for channel := uint32(0); channel < 18; channel++ {
+		c := newChip(t, opl2.ModelYMF262)
+		c.WriteReg(0x105, 0x01)
+		bank, index := channel/9<<8, channel%9
+		op := bank | (index%3 + index/3*8)
+		c.WriteReg(0x20+op, 0x01) // modulator: multiplier 1
+		c.WriteReg(0x40+op, 0x3F) // modulator: silent
+		c.WriteReg(0x60+op, 0xF0) // modulator: fastest attack
+		c.WriteReg(0x23+op, 0x21) // carrier: sustain, multiplier 1
+		c.WriteReg(0x43+op, 0x00) // carrier: loudest
+		c.WriteReg(0x63+op, 0xF0) // carrier: fastest attack
+		c.WriteReg(0x83+op, 0x0F) // carrier: full sustain, fastest release
+		c.WriteReg(0xC0|bank|index, 0x30)
+		c.WriteReg(0xA0|bank|index, 0x98)
+		c.WriteReg(0xB0|bank|index, 0x31) // key on, block 4
+
+		out := make([]int32, 1024*2)
+		c.GenerateBlock3(1024, out)
+		if isSilent(out) {
+			t.Errorf("channel %d: expected the operators written for the channel to play", channel)
+		}
+	}
+}
+
+func TestChipFourOpSwitchWhileKeyed(t *testing.T) {
+	c := newChip(t, opl2.ModelYMF262)
+	c.WriteReg(0x105, 0x01)
+	for _, op := range []uint32{0x00, 0x03, 0x08, 0x0B} {
+		c.WriteReg(0x20+op, 0x21)
+		c.WriteReg(0x40+op, 0x3F)
+		c.WriteReg(0x60+op, 0xF0)
+		c.WriteReg(0x80+op, 0x0F)
+	}
+	c.WriteReg(0x4B, 0x00) // last operator of the pair: loudest
+	c.WriteReg(0xC0, 0x30)
+	c.WriteReg(0xC3, 0x30)
+	c.WriteReg(0xA0, 0x98)
+	c.WriteReg(0xA3, 0x98)
+
+	c.WriteReg(0x104, 0x01)
+	c.WriteReg(0xB0, 0x31) // key on the 4-op channel
+	out := make([]int32, 1024*2)
+	c.GenerateBlock3(1024, out)
+	if isSilent(out) {
+		t.Fatal("expected the 4-op channel to play")
+	}
+
+	c.WriteReg(0xB3, 0x31) // ignored in 4-op mode, but kept for 2-op mode
+
+	c.WriteReg(0x104, 0x00) // back to 2-op while the keys are held
+	c.WriteReg(0xB0, 0x11)  // key off the first channel
+	c.GenerateBlock3(8192, nil)
+	out = make([]int32, 1024*2)
+	c.GenerateBlock3(1024, out)
+	if isSilent(out) {
+		t.Fatal("expected the second channel to keep playing on its own key")
+	}
+
+	c.WriteReg(0xB3, 0x11) // key off the second channel
+	c.GenerateBlock3(8192, nil)
+	out = make([]int32, 1024*2)
+	c.GenerateBlock3(1024, out)
+	if !isSilent(out) {
+		t.Error("expected the second channel to be released")
+	}
+}
+
+func TestChipExactEnvelope(t *testing.T) {
+	const rate = 49716
+	// Decay rate 8 with a key scale of 2 steps the envelope on 6 of every 8 multiples of 16 clock ticks,
+	// the tone drops by 48dB after 256 steps
+	expected := 256 * 16 * 8 / 6.0
+	const window = 160
+	c := newChip(t, opl2.ModelYM3812, opl2.WithExactEnvelope(true))
+	playTone(c, 0x00)
+	c.WriteReg(0x23, 0x01) // carrier: no sustain
+	c.WriteReg(0x63, 0xF8) // carrier: fastest attack, decay rate 8
+	c.WriteReg(0x83, 0xF8) // carrier: lowest sustain level, release rate 8
+	out := make([]int32, rate)
+	c.GenerateBlock2(uint(len(out)), out)
+
+	peak := func(start int) int32 {
+		p := int32(0)
+		for _, s := range out[start : start+window] {
+			if s < 0 {
+				s = -s
+			}
+			if s > p {
+				p = s
+			}
+		}
+		return p
+	}
+	first := peak(0)
+	for i := window; i+window <= len(out); i += window {
+		if peak(i)*256 <= first {
+			if diff := float64(i) - expected; diff < -2*window || diff > window {
+				t.Errorf("expected the tone to drop by 48dB after about %.0f samples, got %d", expected, i)
+			}
+			return
+		}
+	}
+	t.Errorf("expected the tone to drop by 48dB after about %.0f samples", expected)
+}
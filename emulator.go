@@ -0,0 +1,42 @@
+package opl2
+
+// Emulator is the common interface implemented by the emulation cores in this package
+// (DOSBox's DBOPL `Chip` and the `Opal` OPL3 emulator), so they can be used interchangeably
+// The generators overwrite the first samples of `output`, they don't mix into what it held before.
+// A nil output advances the emulator without producing samples.
+type Emulator interface {
+	// WriteReg writes to register `reg` with value `val`
+	WriteReg(reg uint32, val uint8)
+	// WriteRegChecked writes to register `reg` with value `val`, failing when `reg` is not mapped
+	WriteRegChecked(reg uint32, val uint8) error
+	// ReadReg returns the value last written to register `reg`
+	ReadReg(reg uint32) uint8
+	// ReadStatus returns the value of the status register
+	ReadStatus() uint8
+	// GenerateBlock2 generates `total` samples of mono output into `output`, the OPL3 mode output is mixed down
+	GenerateBlock2(total uint, output []int32)
+	// GenerateBlock3 generates `total` samples of interleaved stereo (left, right) output into `output`,
+	// the OPL2 mode output is the same on both sides
+	GenerateBlock3(total uint, output []int32)
+	// GenerateBlock2Checked is GenerateBlock2, returning an error instead of panicking
+	GenerateBlock2Checked(total uint, output []int32) error
+	// GenerateBlock3Checked is GenerateBlock3, returning an error instead of panicking
+	GenerateBlock3Checked(total uint, output []int32) error
+	// GenerateBlock2Float generates `total` samples of normalized mono output into `output` (see FloatScale)
+	GenerateBlock2Float(total uint, output []float32)
+	// GenerateBlock3Float generates `total` samples of normalized interleaved stereo output into `output` (see FloatScale)
+	GenerateBlock3Float(total uint, output []float32)
+	// GenerateBlock2FloatChecked is GenerateBlock2Float, returning an error instead of panicking
+	GenerateBlock2FloatChecked(total uint, output []float32) error
+	// GenerateBlock3FloatChecked is GenerateBlock3Float, returning an error instead of panicking
+	GenerateBlock3FloatChecked(total uint, output []float32) error
+	// Reset returns the emulator to its power-on state, keeping the current sample rate
+	Reset()
+	// GetSampleRate returns the output sample rate of the emulator
+	GetSampleRate() uint32
+}
+
+var (
+	_ Emulator = (*Chip)(nil)
+	_ Emulator = (*Opal)(nil)
+)
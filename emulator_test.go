@@ -0,0 +1,566 @@
+package opl2_test
+
+import (
+	"testing"
+
+	"github.com/gotracker/opl2"
+	"github.com/pkg/errors"
+)
+
+// playTone keys on a simple sine tone on channel 0, with the stereo enables set by `c0`
+func playTone(e opl2.Emulator, c0 uint8) {
+	e.WriteReg(0x20, 0x01) // modulator: multiplier 1
+	e.WriteReg(0x40, 0x3F) // modulator: silent
+	e.WriteReg(0x60, 0xF0) // modulator: fastest attack
+	e.WriteReg(0x23, 0x21) // carrier: sustain, multiplier 1
+	e.WriteReg(0x43, 0x00) // carrier: loudest
+	e.WriteReg(0x63, 0xF0) // carrier: fastest attack
+	e.WriteReg(0x83, 0x0F) // carrier: full sustain, fastest release
+	e.WriteReg(0xC0, c0)
+	e.WriteReg(0xA0, 0x98)
+	e.WriteReg(0xB0, 0x31) // key on, block 4
+}
+
+func TestOpalStereoPanning(t *testing.T) {
+	o := opl2.NewOpal(uint32(opl2.OPL3SampleRate))
+	o.WriteReg(0x105, 0x01)
+	playTone(o, 0x10) // left only
+
+	const count = 1024
+	out := make([]int32, count*2)
+	o.GenerateBlock3(count, out)
+
+	var left, right bool
+	for i := 0; i < count; i++ {
+		left = left || out[i*2+0] != 0
+		right = right || out[i*2+1] != 0
+	}
+	if !left {
+		t.Error("expected output on the left channel")
+	}
+	if right {
+		t.Error("expected silence on the right channel")
+	}
+}
+
+func TestEmulatorOutputLayout(t *testing.T) {
+	type layout struct {
+		left, right, same, tail bool
+	}
+	const count = 1024
+	stereo := func(e opl2.Emulator, opl3 bool) layout {
+		if opl3 {
+			e.WriteReg(0x105, 0x01)
+		}
+		playTone(e, 0x10) // left only in OPL3 mode
+		out := make([]int32, count*2)
+		e.GenerateBlock3(count, out)
+		l := layout{same: true, tail: out[count*2-2] != 0 || out[count*2-4] != 0}
+		for i := 0; i < count; i++ {
+			l.left = l.left || out[i*2+0] != 0
+			l.right = l.right || out[i*2+1] != 0
+			l.same = l.same && out[i*2+0] == out[i*2+1]
+		}
+		return l
+	}
+
+	for _, opl3 := range []bool{false, true} {
+		expected := stereo(opl2.NewOpal(uint32(opl2.OPL3SampleRate)), opl3)
+		if !expected.left || !expected.tail {
+			t.Fatalf("expected Opal output up to the end of the block, got %+v", expected)
+		}
+		chips := map[string]opl2.Emulator{
+			"YMF262": newChip(t, opl2.ModelYMF262),
+		}
+		if !opl3 {
+			chips["YM3812"] = newChip(t, opl2.ModelYM3812)
+		}
+		for name, e := range chips {
+			if l := stereo(e, opl3); l != expected {
+				t.Errorf("%s (OPL3 %v): expected the stereo layout of Opal %+v, got %+v", name, opl3, expected, l)
+			}
+
+			e.Reset()
+			if opl3 {
+				e.WriteReg(0x105, 0x01)
+			}
+			playTone(e, 0x30)
+			out := make([]int32, count)
+			e.GenerateBlock2(count, out)
+			if out[count-1] == 0 && out[count-2] == 0 {
+				t.Errorf("%s (OPL3 %v): expected mono output up to the end of the block", name, opl3)
+			}
+		}
+	}
+
+	// GenerateBlock4 keeps the CHA/CHB layout of GenerateBlock3 in OPL2 mode and on the OPL2 models
+	for _, model := range []opl2.Model{opl2.ModelYMF262, opl2.ModelYM3812, opl2.ModelYM3526} {
+		c := newChip(t, model)
+		playTone(c, 0x00)
+		out := make([]int32, count*4)
+		if err := c.GenerateBlock4Checked(count, out); err != nil {
+			t.Fatalf("%v: %v", model, err)
+		}
+		for i := 0; i < count; i++ {
+			if out[i*4+0] != out[i*4+1] || out[i*4+2] != 0 || out[i*4+3] != 0 {
+				t.Fatalf("%v: expected the mono output on CHA and CHB only, got %v at sample %d", model, out[i*4:i*4+4], i)
+			}
+		}
+		if out[count*4-4] == 0 && out[count*4-8] == 0 {
+			t.Errorf("%v: expected four-output data up to the end of the block", model)
+		}
+	}
+}
+
+func TestEmulatorOverwritesOutput(t *testing.T) {
+	const count = 256
+	emulators := map[string]func() opl2.Emulator{
+		"YM3812": func() opl2.Emulator { return newChip(t, opl2.ModelYM3812) },
+		"YMF262": func() opl2.Emulator { return newChip(t, opl2.ModelYMF262) },
+		"Opal":   func() opl2.Emulator { return opl2.NewOpal(uint32(opl2.OPL3SampleRate)) },
+	}
+	for name, create := range emulators {
+		for _, opl3 := range []bool{false, true} {
+			for _, outputs := range []uint{1, 2} {
+				// a silent emulator clears the buffer
+				e := create()
+				if opl3 {
+					e.WriteReg(0x105, 0x01)
+				}
+				out := make([]int32, count*outputs)
+				for i := range out {
+					out[i] = 100000
+				}
+				if outputs == 1 {
+					e.GenerateBlock2(count, out)
+				} else {
+					e.GenerateBlock3(count, out)
+				}
+				if !isSilent(out) {
+					t.Errorf("%s (OPL3 %v, %d outputs): expected a silent block to clear the buffer", name, opl3, outputs)
+				}
+
+				// a playing emulator gives the same output as into a clean buffer
+				clean := make([]int32, count*outputs)
+				for i, buf := range [][]int32{clean, out} {
+					e := create()
+					if opl3 {
+						e.WriteReg(0x105, 0x01)
+					}
+					playTone(e, 0x30)
+					if i == 1 {
+						for j := range buf {
+							buf[j] = 100000
+						}
+					}
+					if outputs == 1 {
+						e.GenerateBlock2(count, buf)
+					} else {
+						e.GenerateBlock3(count, buf)
+					}
+				}
+				for i := range clean {
+					if out[i] != clean[i] {
+						t.Errorf("%s (OPL3 %v, %d outputs): expected %d at %d, got %d", name, opl3, outputs, clean[i], i, out[i])
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestReadRegShadow(t *testing.T) {
+	emulators := map[string]opl2.Emulator{
+		"Chip": newChip(t, opl2.ModelYMF262),
+		"Opal": opl2.NewOpal(uint32(opl2.OPL3SampleRate)),
+	}
+	for name, e := range emulators {
+		e.WriteReg(0x105, 0x01)
+		playTone(e, 0x30)
+		e.WriteReg(0x02, 0x9C)
+		e.WriteReg(0x1A5, 0x42)
+
+		for reg, expected := range map[uint32]uint8{0x02: 0x9C, 0x43: 0x00, 0x63: 0xF0, 0xA0: 0x98, 0xB0: 0x31, 0x1A5: 0x42, 0x15: 0x00} {
+			if val := e.ReadReg(reg); val != expected {
+				t.Errorf("%s: register %0.3X: expected %0.2X, got %0.2X", name, reg, expected, val)
+			}
+		}
+
+		var ch opl2.ChannelRegs
+		if err := ch.ReadFrom(e, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !ch.KeyOn || ch.Block != 4 || ch.FNum != 0x198 || !ch.Left || !ch.Right {
+			t.Errorf("%s: unexpected channel registers %+v", name, ch)
+		}
+
+		e.Reset()
+		if val := e.ReadReg(0xA0); val != 0 {
+			t.Errorf("%s: expected register A0 to be cleared by reset, got %0.2X", name, val)
+		}
+	}
+}
+
+func TestFloatOutputLoudness(t *testing.T) {
+	const count = 4096
+	peak := func(name string, e opl2.Emulator, opl3 bool) float32 {
+		if opl3 {
+			e.WriteReg(0x105, 0x01)
+		}
+		playTone(e, 0x10) // left only in OPL3 mode
+		out := make([]float32, count*2)
+		e.GenerateBlock3Float(count, out)
+		if out[count*2-2] == 0 && out[count*2-4] == 0 {
+			t.Errorf("%s (OPL3 %v): expected output in the last frames", name, opl3)
+		}
+		var p float32
+		for i := 0; i < count; i++ {
+			l, r := out[i*2+0], out[i*2+1]
+			if opl3 && r != 0 {
+				t.Fatalf("%s: expected silence on the right channel, got %f at frame %d", name, r, i)
+			} else if !opl3 && l != r {
+				t.Fatalf("%s: expected the same output on both channels in OPL2 mode, got %f and %f at frame %d", name, l, r, i)
+			}
+			if l < 0 {
+				l = -l
+			}
+			if l > p {
+				p = l
+			}
+		}
+		return p
+	}
+
+	for _, opl3 := range []bool{false, true} {
+		chipPeak := peak("Chip", newChip(t, opl2.ModelYMF262), opl3)
+		opalPeak := peak("Opal", opl2.NewOpal(uint32(opl2.OPL3SampleRate)), opl3)
+		if chipPeak <= 0 || chipPeak > 1 || opalPeak <= 0 || opalPeak > 1 {
+			t.Fatalf("expected peaks within (0, 1], got %f (Chip) and %f (Opal)", chipPeak, opalPeak)
+		}
+		if ratio := chipPeak / opalPeak; ratio < 0.9 || ratio > 1.1 {
+			t.Errorf("expected matching loudness, got peaks of %f (Chip) and %f (Opal)", chipPeak, opalPeak)
+		}
+	}
+}
+
+func TestCheckedAPI(t *testing.T) {
+	emulators := map[string]opl2.Emulator{
+		"Chip": newChip(t, opl2.ModelYMF262),
+		"Opal": opl2.NewOpal(uint32(opl2.OPL3SampleRate)),
+	}
+	for name, e := range emulators {
+		for _, reg := range []uint32{0x00, 0x15, 0x26, 0xA9, 0xD3, 0xF6, 0x1BD, 0x200} {
+			err := e.WriteRegChecked(reg, 0x00)
+			var regErr *opl2.RegisterError
+			if !errors.As(err, &regErr) || regErr.Reg != reg || !errors.Is(err, opl2.ErrUnmappedRegister) {
+				t.Errorf("%s: expected an unmapped register error for %0.3X, got %v", name, reg, err)
+			}
+		}
+		// the second bank is mapped once the OPL3 mode is enabled
+		if err := e.WriteRegChecked(0x1B3, 0x00); !errors.Is(err, opl2.ErrUnmappedRegister) {
+			t.Errorf("%s: expected the second bank to be unmapped in OPL2 mode, got %v", name, err)
+		}
+		if err := e.WriteRegChecked(0x105, 0x01); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		for _, reg := range []uint32{0x01, 0x08, 0x35, 0xA8, 0xBD, 0xC8, 0xF5, 0x104, 0x1B3} {
+			if err := e.WriteRegChecked(reg, 0x00); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+
+		if err := e.GenerateBlock2Checked(16, make([]int32, 8)); !errors.Is(err, opl2.ErrOutputTooSmall) {
+			t.Errorf("%s: expected an output too small error, got %v", name, err)
+		}
+		if err := e.GenerateBlock3Checked(16, make([]int32, 16)); !errors.Is(err, opl2.ErrOutputTooSmall) {
+			t.Errorf("%s: expected an output too small error, got %v", name, err)
+		}
+		if err := e.GenerateBlock2FloatChecked(16, make([]float32, 8)); !errors.Is(err, opl2.ErrOutputTooSmall) {
+			t.Errorf("%s: expected an output too small error, got %v", name, err)
+		}
+		if err := e.GenerateBlock3FloatChecked(16, make([]float32, 16)); !errors.Is(err, opl2.ErrOutputTooSmall) {
+			t.Errorf("%s: expected an output too small error, got %v", name, err)
+		}
+		// a nil output advances the emulator, like with the integer generators
+		e.GenerateBlock2Float(16, nil)
+		e.GenerateBlock3Float(16, nil)
+		if err := e.GenerateBlock3FloatChecked(16, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	opl2Chip := newChip(t, opl2.ModelYM3812)
+	if err := opl2Chip.WriteRegChecked(0x1A0, 0x00); !errors.Is(err, opl2.ErrUnmappedRegister) {
+		t.Errorf("expected the second bank to be unmapped on an OPL2, got %v", err)
+	}
+}
+
+func TestClockScalesPitch(t *testing.T) {
+	crossings := func(e opl2.Emulator) int {
+		playTone(e, 0x30)
+		out := make([]int32, 8192)
+		e.GenerateBlock2(uint(len(out)), out)
+		n := 0
+		for i := 1; i < len(out); i++ {
+			if (out[i-1] < 0) != (out[i] < 0) {
+				n++
+			}
+		}
+		return n
+	}
+
+	nominal := newChip(t, opl2.ModelYM3812)
+	fast := newChip(t, opl2.ModelYM3812, opl2.WithClock(2*opl2.ModelYM3812.DefaultClock()))
+	opal := opl2.NewOpal(uint32(opl2.OPL3SampleRate))
+	fastOpal := opl2.NewOpal(uint32(opl2.OPL3SampleRate))
+	if err := fastOpal.SetClock(2 * opl2.ModelYMF262.DefaultClock()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, pair := range map[string][2]opl2.Emulator{"Chip": {nominal, fast}, "Opal": {opal, fastOpal}} {
+		base, doubled := crossings(pair[0]), crossings(pair[1])
+		if diff := doubled - 2*base; diff < -4 || diff > 4 {
+			t.Errorf("%s: expected twice the clock to double the pitch, got %d and %d zero crossings", name, base, doubled)
+		}
+	}
+}
+
+func TestClockTooSlow(t *testing.T) {
+	const clock = 10000
+	if _, err := opl2.NewChip(44100, opl2.WithClock(clock)); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("NewChip: expected ErrUnsupportedOption for a %d Hz clock, got %v", clock, err)
+	}
+
+	c := newChip(t, opl2.ModelYM3812)
+	if err := c.SetClock(clock); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("Chip.SetClock: expected ErrUnsupportedOption for a %d Hz clock, got %v", clock, err)
+	}
+	if err := c.SetClock(0); err != nil {
+		t.Errorf("Chip.SetClock: the nominal clock should still be accepted, got %v", err)
+	}
+
+	o := opl2.NewOpal(44100)
+	if err := o.SetClock(clock); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("Opal.SetClock: expected ErrUnsupportedOption for a %d Hz clock, got %v", clock, err)
+	}
+	if o.MasterClock != int32(opl2.ModelYMF262.DefaultClock()) {
+		t.Errorf("Opal.SetClock: a rejected clock changed the master clock to %d Hz", o.MasterClock)
+	}
+}
+
+func TestRhythmPanning(t *testing.T) {
+	tests := []struct {
+		name        string
+		bd          uint8
+		left, right bool
+	}{
+		{"drums outside rhythm mode", 0x10, false, false},
+		{"bass drum", 0x30, true, false},
+		{"snare drum", 0x28, false, true},
+		{"hi-hat", 0x21, false, true},
+		{"tom-tom", 0x24, false, false},
+	}
+
+	emulators := map[string]opl2.Emulator{
+		"Chip": newChip(t, opl2.ModelYMF262),
+		"Opal": opl2.NewOpal(uint32(opl2.OPL3SampleRate)),
+	}
+	for name, e := range emulators {
+		e.WriteReg(0x105, 0x01)
+		e.WriteReg(0xC6, 0x10) // bass drum: left only
+		e.WriteReg(0xC7, 0x20) // hi-hat and snare drum: right only
+		e.WriteReg(0xC8, 0x00) // tom-tom and top cymbal: muted
+		for _, op := range []uint32{0x10, 0x13, 0x11, 0x14, 0x12, 0x15} {
+			e.WriteReg(0x40+op, 0x00)
+			e.WriteReg(0x60+op, 0xF0)
+			e.WriteReg(0x80+op, 0x0F)
+		}
+		e.WriteReg(0xA6, 0x98)
+		e.WriteReg(0xB6, 0x11)
+
+		for _, tt := range tests {
+			e.WriteReg(0xBD, tt.bd)
+			out := make([]int32, 1024*2)
+			e.GenerateBlock3(1024, out)
+			// release the drums before the next one
+			e.WriteReg(0xBD, tt.bd&0x20)
+			e.GenerateBlock3(4096, make([]int32, 4096*2))
+
+			var left, right bool
+			for i := 0; i < len(out); i += 2 {
+				left = left || out[i+0] != 0
+				right = right || out[i+1] != 0
+			}
+			if left != tt.left || right != tt.right {
+				t.Errorf("%s: %s: expected left %v right %v, got left %v right %v", name, tt.name, tt.left, tt.right, left, right)
+			}
+		}
+	}
+}
+
+func TestOpalOPL2Mode(t *testing.T) {
+	o := opl2.NewOpal(uint32(opl2.OPL3SampleRate))
+	generate := func() (left, right bool) {
+		out := make([]int32, 1024*2)
+		o.GenerateBlock3(1024, out)
+		for i := 0; i < len(out); i += 2 {
+			left = left || out[i+0] != 0
+			right = right || out[i+1] != 0
+		}
+		return
+	}
+
+	// the stereo bits are ignored in OPL2 mode
+	playTone(o, 0x10)
+	if left, right := generate(); !left || !right {
+		t.Errorf("expected both channels in OPL2 mode, got left %v right %v", left, right)
+	}
+
+	// the second bank is not played in OPL2 mode
+	o.Reset()
+	o.WriteReg(0x143, 0x00)
+	o.WriteReg(0x163, 0xF0)
+	o.WriteReg(0x1A0, 0x98)
+	o.WriteReg(0x1B0, 0x31)
+	if left, right := generate(); left || right {
+		t.Errorf("expected the second bank to stay silent in OPL2 mode, got left %v right %v", left, right)
+	}
+
+	// waveforms above 3 are limited to the OPL2 waveforms, and to the sine without waveform select
+	half := func(wse, wave uint8) bool {
+		o.Reset()
+		o.WriteReg(0x01, wse)
+		o.WriteReg(0xE3, wave)
+		playTone(o, 0x00)
+		out := make([]int32, 1024)
+		o.GenerateBlock2(uint(len(out)), out)
+		for _, s := range out {
+			if s < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if half(0x00, 0x05) {
+		t.Errorf("expected the sine without waveform select")
+	}
+	if !half(0x20, 0x06) {
+		t.Errorf("expected the positive sine for waveform 6 in OPL2 mode")
+	}
+}
+
+func TestSecondBankInOPL2Mode(t *testing.T) {
+	emulators := map[string]opl2.Emulator{
+		"Chip": newChip(t, opl2.ModelYMF262),
+		"Opal": opl2.NewOpal(uint32(opl2.OPL3SampleRate)),
+	}
+	for name, e := range emulators {
+		e.WriteReg(0x1A0, 0x98)
+		if val := e.ReadReg(0xA0); val != 0x00 {
+			t.Errorf("%s: expected the write to 1A0 to stay off A0 in OPL2 mode, got %0.2X", name, val)
+		}
+
+		// the 4-op enables are set up before the OPL3 mode, without reaching the timer control
+		if err := e.WriteRegChecked(0x104, 0x01); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if val := e.ReadReg(0x04); val != 0x00 {
+			t.Errorf("%s: expected the write to 104 to stay off 04 in OPL2 mode, got %0.2X", name, val)
+		}
+		e.WriteReg(0x105, 0x01)
+		var fourOp opl2.FourOpReg
+		fourOp.Decode(e.ReadReg(0x104))
+		if !fourOp.Enable[0] {
+			t.Errorf("%s: expected the first 4-op pair to be enabled, got %+v", name, fourOp)
+		}
+
+		e.WriteReg(0x1A0, 0x42)
+		if val := e.ReadReg(0x1A0); val != 0x42 {
+			t.Errorf("%s: expected the write to 1A0 to reach the second bank in OPL3 mode, got %0.2X", name, val)
+		}
+		if val := e.ReadReg(0xA0); val != 0x00 {
+			t.Errorf("%s: expected A0 to be left alone in OPL3 mode, got %0.2X", name, val)
+		}
+	}
+
+	// the address port of the second bank selects the first bank in OPL2 mode
+	c := newChip(t, opl2.ModelYMF262)
+	c.WritePort(0x38A, 0xA0)
+	c.WritePort(0x38B, 0x98)
+	if val := c.ReadReg(0xA0); val != 0x98 {
+		t.Errorf("expected the write through the second bank port to reach A0 in OPL2 mode, got %0.2X", val)
+	}
+}
+
+func TestSecondBankLatchedInOPL2Mode(t *testing.T) {
+	const count = 1024
+	type layout struct{ left, right bool }
+	generate := func(e opl2.Emulator) (l layout) {
+		out := make([]int32, count*2)
+		e.GenerateBlock3(count, out)
+		for i := 0; i < count; i++ {
+			l.left = l.left || out[i*2+0] != 0
+			l.right = l.right || out[i*2+1] != 0
+		}
+		return
+	}
+
+	emulators := map[string]opl2.Emulator{
+		"Chip": newChip(t, opl2.ModelYMF262),
+		"Opal": opl2.NewOpal(uint32(opl2.OPL3SampleRate)),
+	}
+	for name, e := range emulators {
+		// a voice on the first channel of the second bank, programmed before the OPL3 mode
+		e.WriteReg(0x140, 0x3F) // modulator: silent
+		e.WriteReg(0x123, 0x21) // carrier: sustain, multiplier 1
+		e.WriteReg(0x143, 0x00) // carrier: loudest
+		e.WriteReg(0x163, 0xF0) // carrier: fastest attack
+		e.WriteReg(0x1C0, 0x10) // left only
+		e.WriteReg(0x1A0, 0x98)
+		e.WriteReg(0x1B0, 0x31) // key on, block 4
+		if l := generate(e); l.left || l.right {
+			t.Errorf("%s: expected the second bank to stay silent in OPL2 mode, got %+v", name, l)
+		}
+
+		e.WriteReg(0x105, 0x01)
+		if l := generate(e); !l.left || l.right {
+			t.Errorf("%s: expected the voice written in OPL2 mode to play on the left in OPL3 mode, got %+v", name, l)
+		}
+	}
+}
+
+func TestOpalSkip(t *testing.T) {
+	for _, quality := range []opl2.ResampleQuality{opl2.ResampleLinear, opl2.ResampleSincHigh} {
+		for _, rate := range []uint32{44100, 96000} {
+			skipped := opl2.NewOpal(rate)
+			rendered := opl2.NewOpal(rate)
+			for _, o := range []*opl2.Opal{skipped, rendered} {
+				if err := o.SetResampleQuality(quality); err != nil {
+					t.Fatal(err)
+				}
+				playTone(o, 0x0E)      // full feedback
+				o.WriteReg(0x51, 0x00) // hi-hat: loudest
+				o.WriteReg(0x71, 0xF0) // hi-hat: fastest attack
+				o.WriteReg(0xBD, 0x21) // hi-hat
+			}
+
+			skipped.GenerateBlock3(1000, nil)
+			if err := skipped.GenerateBlock2Checked(1000, nil); err != nil {
+				t.Fatal(err)
+			}
+			rendered.GenerateBlock3(1000, make([]int32, 1000*2))
+			rendered.GenerateBlock2(1000, make([]int32, 1000))
+
+			want := make([]int32, 1000)
+			got := make([]int32, 1000)
+			rendered.GenerateBlock2(uint(len(want)), want)
+			skipped.GenerateBlock2(uint(len(got)), got)
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("quality %d at %d Hz: expected the same output after skipping, sample %d is %d instead of %d", quality, rate, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
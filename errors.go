@@ -0,0 +1,41 @@
+package opl2
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidBank is returned when a register bank other than 0 or 1 is requested
+	ErrInvalidBank = errors.New("invalid register bank")
+	// ErrInvalidChannel is returned when a channel outside of 0-8 is requested within a bank
+	ErrInvalidChannel = errors.New("invalid channel")
+	// ErrInvalidOperator is returned when an operator other than 0 or 1 is requested within a channel
+	ErrInvalidOperator = errors.New("invalid operator")
+	// ErrUnmappedRegister is returned when writing to an address that has no register behind it
+	ErrUnmappedRegister = errors.New("unmapped register")
+	// ErrOutputTooSmall is returned when the output buffer cannot hold the requested amount of samples
+	ErrOutputTooSmall = errors.New("output buffer too small")
+	// ErrInvalidSynthMode is returned when a channel is found in an inconsistent synthesis mode
+	ErrInvalidSynthMode = errors.New("invalid synth mode")
+	// ErrInvalidSampleRate is returned when a chip is created with, or set to, a sample rate of 0
+	ErrInvalidSampleRate = errors.New("invalid sample rate")
+	// ErrUnsupportedOption is returned when an option or combination of options is not supported
+	ErrUnsupportedOption = errors.New("unsupported option")
+)
+
+// RegisterError describes a failed access to the register at address `Reg`
+type RegisterError struct {
+	Reg uint32
+	Err error
+}
+
+func (e *RegisterError) Error() string {
+	return fmt.Sprintf("register %0.3X: %v", e.Reg, e.Err)
+}
+
+// Unwrap returns the reason of the failure
+func (e *RegisterError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,46 @@
+package opl2
+
+import "github.com/pkg/errors"
+
+// FloatScale is the factor that converts the integer output of the GenerateBlock functions into the
+// normalized float32 output: a value of 1.0 matches the full scale of a signed 16-bit sample (32768)
+// Both cores produce their integer output at 16-bit scale, so their float32 output has matching loudness
+// Opal clamps its output to the 16-bit range, Chip does not and can exceed [-1.0, 1.0] on loud passages
+const FloatScale = 1.0 / 32768.0
+
+// int32Scratch returns a zeroed buffer of `size` entries, reusing the memory of `buf` when possible
+func int32Scratch(buf *[]int32, size uint) []int32 {
+	if uint(cap(*buf)) < size {
+		*buf = make([]int32, size)
+	}
+	out := (*buf)[:size]
+	for i := range out {
+		out[i] = 0
+	}
+	return out
+}
+
+// convertToFloat writes the normalized values of `src` into `dst`
+func convertToFloat(dst []float32, src []int32) {
+	for i, s := range src {
+		dst[i] = float32(s) * FloatScale
+	}
+}
+
+// generateFloat runs `generate` for `total` samples of `outputs` interleaved values and converts them into `output`
+// The integer samples go through the scratch buffer `buf`. A nil output advances the emulator without producing
+// samples, like the integer generators.
+func generateFloat(total, outputs uint, output []float32, buf *[]int32, generate func(total uint, output []int32) error) error {
+	if output == nil {
+		return generate(total, nil)
+	}
+	if uint(len(output)) < total*outputs {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", total, uint(len(output))/outputs)
+	}
+	ints := int32Scratch(buf, total*outputs)
+	if err := generate(total, ints); err != nil {
+		return err
+	}
+	convertToFloat(output, ints)
+	return nil
+}
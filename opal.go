@@ -1,5 +1,7 @@
 package opl2
 
+import "github.com/pkg/errors"
+
 // Pure Go conversion of original C++ file
 
 // This is the Opal OPL3 emulator from Reality Adlib Tracker v2.0a (http://www.3eality.com/productions/reality-adlib-tracker).
@@ -15,17 +17,16 @@ package opl2
 
    Missing features compared to a real OPL3:
 
-       - Timers/interrupts
-       - OPL3 enable bit (it defaults to always on)
        - CSW mode
        - Test register
-       - Percussion mode
 
 */
 
 // Various constants
 const (
 	OPL3SampleRate = 49716
+	// OPL3ClockDivider is the amount of master clock cycles per native OPL3 sample
+	OPL3ClockDivider = 288
 
 	NumChannels  = 18
 	NumOperators = 36
@@ -41,6 +42,12 @@ const (
 	envStageRel
 )
 
+// Sources that can key an operator on, it plays as long as any of them holds it
+const (
+	keyNormal = uint8(1 << iota) // Key-on bit of the channel (0xB0)
+	keyDrum                      // Drum bits of the rhythm mode (0xBD)
+)
+
 var opalRateTables = [4][8]uint16{
 	{1, 0, 1, 0, 1, 0, 1, 0},
 	{1, 0, 1, 0, 0, 0, 1, 0},
@@ -116,8 +123,9 @@ type operator struct {
 	KeyScaleLevel  uint16
 	Out            [2]int16
 	KeyOn          bool
-	KeyScaleRate   bool // Affects envelope rate scaling
-	SustainMode    bool // Whether to sustain during the sustain phase, or release instead
+	KeySources     uint8 // Mask of the sources holding the key on (see key* consts above)
+	KeyScaleRate   bool  // Affects envelope rate scaling
+	SustainMode    bool  // Whether to sustain during the sustain phase, or release instead
 	TremoloEnable  bool
 	VibratoEnable  bool
 }
@@ -140,6 +148,7 @@ func (o *operator) Init() {
 	o.Out[0] = 0
 	o.Out[1] = 0
 	o.KeyOn = false
+	o.KeySources = 0
 	o.KeyScaleRate = false
 	o.SustainMode = false
 	o.TremoloEnable = false
@@ -148,6 +157,22 @@ func (o *operator) Init() {
 
 // Output - Produce output from operator.
 func (o *operator) Output(_ uint16, phaseStep uint32, vibrato int16, mod int16, fbshift int16) int16 {
+	level, running := o.Forward(phaseStep, vibrato)
+	if !running {
+		return 0
+	}
+
+	// Feedback?  In that case we modulate by a blend of the last two samples
+	if fbshift != 0 {
+		mod += (o.Out[0] + o.Out[1]) >> fbshift
+	}
+
+	return o.Wave(uint16(uint32(o.Phase>>10)+uint32(mod)), level)
+}
+
+// Forward - Advance the wave phase and the envelope of the operator by a sample.  Returns the level
+// to produce the sample at, and false if the envelope isn't running.
+func (o *operator) Forward(phaseStep uint32, vibrato int16) (uint16, bool) {
 
 	// Advance wave phase
 	if o.VibratoEnable {
@@ -211,22 +236,21 @@ func (o *operator) Output(_ uint16, phaseStep uint32, vibrato int16, mod int16,
 			o.EnvelopeStage = envStageOff
 			o.Out[0] = 0
 			o.Out[1] = 0
-			return 0
+			return 0, false
 		}
 
 	// Envelope, and therefore the operator, is not running
 	default:
 		o.Out[0] = 0
 		o.Out[1] = 0
-		return 0
+		return 0, false
 	}
 
-	// Feedback?  In that case we modulate by a blend of the last two samples
-	if fbshift != 0 {
-		mod += (o.Out[0] + o.Out[1]) >> fbshift
-	}
+	return level, true
+}
 
-	phase := uint16(uint32(o.Phase>>10) + uint32(mod))
+// Wave - Produce a sample of the operator's waveform at a 10-bit phase and a level.
+func (o *operator) Wave(phase uint16, level uint16) int16 {
 	offset := phase & 0xFF
 	var logsin uint16
 	negate := false
@@ -332,8 +356,16 @@ func (o *operator) Output(_ uint16, phaseStep uint32, vibrato int16, mod int16,
 	return v
 }
 
-// SetKeyOn - Trigger operator.
-func (o *operator) SetKeyOn(on bool) {
+// SetKeyOn - Trigger operator from one of the key sources.  The operator stays keyed on while any
+// source holds it.
+func (o *operator) SetKeyOn(on bool, source uint8) {
+	if on {
+		o.KeySources |= source
+	} else {
+		o.KeySources &^= source
+	}
+	on = o.KeySources != 0
+
 	// Already on/off?
 	if o.KeyOn == on {
 		return
@@ -546,6 +578,8 @@ type channel struct {
 	Enable         bool
 	LeftEnable     bool
 	RightEnable    bool
+	LeftSelect     bool // Stereo bits of register C0, both outputs are enabled in OPL2 mode
+	RightSelect    bool
 }
 
 // Init - Channel constructor.
@@ -559,6 +593,8 @@ func (c *channel) Init() {
 	c.ModulationType = 0
 	c.ChannelPair = nil
 	c.Enable = true
+	c.LeftSelect = false
+	c.RightSelect = false
 }
 
 func (c *channel) SetMaster(opal *Opal) {
@@ -610,25 +646,7 @@ func (c *channel) Output() (int16, int16) {
 		return 0, 0
 	}
 
-	vibrato := int16(c.Freq>>7) & 7
-	if !c.Master.VibratoDepth {
-		vibrato >>= 1
-	}
-
-	// 0  3  7  3  0  -3  -7  -3
-	clk := c.Master.VibratoClock
-	if (clk & 3) == 0 {
-		vibrato = 0 // Position 0 and 4 is zero
-	} else {
-		if (clk & 1) != 0 {
-			vibrato >>= 1 // Odd positions are half the magnitude
-		}
-		if (clk & 4) != 0 {
-			vibrato = -vibrato // The second half positions are negative
-		}
-	}
-
-	vibrato <<= c.Octave
+	vibrato := c.Vibrato()
 
 	// Combine individual operator outputs
 	var out, acc int16
@@ -691,6 +709,45 @@ func (c *channel) Output() (int16, int16) {
 	return l, r
 }
 
+// Forward - Advance the operators of the channel by a sample, the same as Output without producing it.
+func (c *channel) Forward() {
+	if !c.Enable {
+		return
+	}
+
+	vibrato := c.Vibrato()
+	ops := c.Op[:2]
+	if c.ChannelPair != nil {
+		ops = c.Op[:]
+	}
+	for _, op := range ops {
+		op.Forward(c.PhaseStep, vibrato)
+	}
+}
+
+// Vibrato - Current vibrato offset of the phase step of the channel.
+func (c *channel) Vibrato() int16 {
+	vibrato := int16(c.Freq>>7) & 7
+	if !c.Master.VibratoDepth {
+		vibrato >>= 1
+	}
+
+	// 0  3  7  3  0  -3  -7  -3
+	clk := c.Master.VibratoClock
+	if (clk & 3) == 0 {
+		vibrato = 0 // Position 0 and 4 is zero
+	} else {
+		if (clk & 1) != 0 {
+			vibrato >>= 1 // Odd positions are half the magnitude
+		}
+		if (clk & 4) != 0 {
+			vibrato = -vibrato // The second half positions are negative
+		}
+	}
+
+	return vibrato << c.Octave
+}
+
 // SetFrequencyLow - Set phase step for operators using this channel.
 func (c *channel) SetFrequencyLow(freq uint16) {
 	c.Freq = (c.Freq & 0x300) | (freq & 0xFF)
@@ -715,18 +772,28 @@ func (c *channel) SetOctave(oct uint16) {
 
 // SetKeyOn - Keys the channel on/off.
 func (c *channel) SetKeyOn(on bool) {
-	c.Op[0].SetKeyOn(on)
-	c.Op[1].SetKeyOn(on)
+	c.Op[0].SetKeyOn(on, keyNormal)
+	c.Op[1].SetKeyOn(on, keyNormal)
 }
 
 // SetLeftEnable - Enable left stereo channel.
 func (c *channel) SetLeftEnable(on bool) {
-	c.LeftEnable = on
+	c.LeftSelect = on
+	c.ComputeStereo()
 }
 
 // SetRightEnable - Enable right stereo channel.
 func (c *channel) SetRightEnable(on bool) {
-	c.RightEnable = on
+	c.RightSelect = on
+	c.ComputeStereo()
+}
+
+// ComputeStereo - Compute which stereo channels are enabled.  The stereo bits only apply in OPL3 mode,
+// in OPL2 mode the channel plays on both.
+func (c *channel) ComputeStereo() {
+	opl2Mode := !c.Master.OPL3Mode
+	c.LeftEnable = opl2Mode || c.LeftSelect
+	c.RightEnable = opl2Mode || c.RightSelect
 }
 
 // SetFeedback - Set the channel feedback amount.
@@ -775,6 +842,7 @@ func (c *channel) ComputeKeyScaleNumber() {
 type Opal struct {
 	SampleRate   int32
 	SampleAccum  int32
+	MasterClock  int32 // Master clock in Hz, the native sample rate is MasterClock / OPL3ClockDivider
 	LastOutput   [2]int16
 	CurrOutput   [2]int16
 	Chan         [NumChannels]channel
@@ -787,6 +855,17 @@ type Opal struct {
 	NoteSel      bool
 	TremoloDepth bool
 	VibratoDepth bool
+	RhythmMode   bool
+	OPL3Mode     bool            // NEW bit of register 105, the Opal powers on in OPL2 mode
+	WaveSelect   bool            // WSE bit of register 01, enables waveforms 1-3 in OPL2 mode
+	Reg104       uint8           // 4-op enables, they only apply in OPL3 mode
+	Noise        uint32          // 23-bit noise generator of the hi-hat, snare drum and cymbal
+	regs         [512]uint8      // Shadow of the last values written to every register
+	floatBuf     []int32         // Scratch buffer for the float conversion
+	timers       timers          // Timers 1 and 2 and the status flags they raise
+	onIRQ        IRQHandler      // Called when a timer overflow raises the IRQ
+	Quality      ResampleQuality // Conversion to the output sample rate, see SetResampleQuality
+	resampler    *sincResampler  // Filter of the sinc resample qualities, nil for linear interpolation
 	//ExpTable     [256]uint16
 	//LogSinTable  [256]uint16
 }
@@ -805,6 +884,13 @@ func (o *Opal) Init(sampleRate int) {
 	o.NoteSel = false
 	o.TremoloDepth = false
 	o.VibratoDepth = false
+	o.RhythmMode = false
+	o.OPL3Mode = false
+	o.WaveSelect = false
+	o.Reg104 = 0
+	o.Noise = 1
+	o.regs = [512]uint8{}
+	o.timers.reset()
 
 	//	// Build the exponentiation table (reversed from the official OPL3 ROM)
 	//	for i := 0; i < 0x100; i++ {
@@ -827,6 +913,7 @@ func (o *Opal) Init(sampleRate int) {
 		ch := &o.Chan[i]
 		ch.Init()
 		ch.SetMaster(o)
+		ch.ComputeStereo()
 	}
 
 	// Add the operators to the channels.  Note, some channels can't use all the operators
@@ -858,12 +945,18 @@ func (o *Opal) SetSampleRate(sampleRate int) {
 		sampleRate = OPL3SampleRate
 	}
 
+	if o.MasterClock == 0 {
+		o.MasterClock = int32(ModelYMF262.DefaultClock())
+	}
+
 	o.SampleRate = int32(sampleRate)
 	o.SampleAccum = 0
+	o.timers.setRate(uint32(sampleRate), uint32(o.MasterClock), ModelYMF262.DefaultClock())
 	o.LastOutput[0] = 0
 	o.LastOutput[1] = 0
 	o.CurrOutput[0] = 0
 	o.CurrOutput[1] = 0
+	o.setupResampler()
 }
 
 var opLookup = []int8{
@@ -873,13 +966,31 @@ var opLookup = []int8{
 	12, 13, 14, 15, 16, 17, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1,
 }
 
+// SetClock - Change the master clock in Hz, 0 selects the nominal 14.31818 MHz.  Pitch, envelope
+// rates and LFO speed all follow the native sample rate, which is the clock divided by 288.  A clock
+// too slow for the sample rate fails with ErrUnsupportedOption and leaves the emulator unchanged.
+func (o *Opal) SetClock(clock uint32) error {
+	if clock == 0 {
+		clock = ModelYMF262.DefaultClock()
+	}
+	if err := checkRateScale(ModelYMF262, clock, uint32(o.SampleRate)); err != nil {
+		return err
+	}
+	o.MasterClock = int32(clock)
+	o.SetSampleRate(int(o.SampleRate))
+	return nil
+}
+
 // Port - Write a value to an OPL3 register.
 func (o *Opal) Port(regNum uint16, val uint8) {
+	o.regs[regNum&0x1FF] = val
 
+	// The second register bank is latched in OPL2 mode too, its channels are only played in OPL3 mode
 	// Is it BD, the one-off register stuck in the middle of the register array?
 	if regNum == 0xBD {
 		o.TremoloDepth = (val & 0x80) != 0
 		o.VibratoDepth = (val & 0x40) != 0
+		o.portRhythm(val)
 		return
 	}
 
@@ -896,26 +1007,58 @@ func (o *Opal) Port(regNum uint16, val uint8) {
 
 // Sample - Generate sample. Every time you call this you will get two signed 16-bit samples (one for each
 // stereo channel) which will sound correct when played back at the sample rate given when the
-// class was constructed.
+// class was constructed.  They're resampled from the OPL3 sample rate as selected by
+// SetResampleQuality.
 func (o *Opal) Sample() (int16, int16) {
+	period, accum := o.forward(true)
+	if o.resampler != nil {
+		return o.resampler.sample(float64(accum) / float64(period))
+	}
+
+	// Mix with the partial accumulation
+	omblend := period - accum
+	l := int16((int64(o.LastOutput[0])*omblend + int64(o.CurrOutput[0])*accum) / period)
+	r := int16((int64(o.LastOutput[1])*omblend + int64(o.CurrOutput[1])*accum) / period)
+
+	return l, r
+}
+
+// Skip - Advance the emulation by one sample at the output rate, without producing it.  Only the
+// envelopes, phases, noise and LFOs are run, nothing is mixed.  The interpolation and the operator
+// feedback keep working from the samples produced before the skip, until the next ones are produced.
+func (o *Opal) Skip() {
+	o.forward(false)
+}
+
+// forward - Run the chip up to the next output sample, mixing the OPL3 samples if `mix` is set.  Returns
+// the length of an output sample and the position of the output sample after the current OPL3 sample,
+// both in accumulator units.
+func (o *Opal) forward(mix bool) (int64, int64) {
 	// If the destination sample rate is higher than the OPL3 sample rate, we need to skip ahead
-	for o.SampleAccum >= o.SampleRate {
+	// The accumulator counts master clock cycles scaled by the sample rate, so that it stays integer
+	period := int64(o.SampleRate) * OPL3ClockDivider
+	accum := int64(o.SampleAccum)
+	for accum >= period {
+		if !mix {
+			o.advance()
+			accum -= period
+			continue
+		}
+
 		o.LastOutput[0] = o.CurrOutput[0]
 		o.LastOutput[1] = o.CurrOutput[1]
 
 		o.CurrOutput[0], o.CurrOutput[1] = o.Output()
+		if o.resampler != nil {
+			o.resampler.push(o.CurrOutput[0], o.CurrOutput[1])
+		}
 
-		o.SampleAccum -= o.SampleRate
+		accum -= period
 	}
 
-	// Mix with the partial accumulation
-	omblend := int32(o.SampleRate - o.SampleAccum)
-	l := int16((int32(o.LastOutput[0])*omblend + int32(o.CurrOutput[0])*o.SampleAccum) / o.SampleRate)
-	r := int16((int32(o.LastOutput[1])*omblend + int32(o.CurrOutput[1])*o.SampleAccum) / o.SampleRate)
-
-	o.SampleAccum += OPL3SampleRate
+	o.SampleAccum = int32(accum + int64(o.MasterClock))
 
-	return l, r
+	return period, accum
 }
 
 // Output - Produce final output from the chip.  This is at the OPL3 sample-rate.
@@ -925,10 +1068,18 @@ func (o *Opal) Output() (int16, int16) {
 
 	// Sum the output of each channel
 	for i := range o.Chan {
+		if !o.playing(i) {
+			continue
+		}
 		chanL, chanR := o.Chan[i].Output()
 		lmix += int32(chanL)
 		rmix += int32(chanR)
 	}
+	if o.RhythmMode {
+		drumL, drumR := o.rhythmOutput()
+		lmix += drumL
+		rmix += drumR
+	}
 
 	// Clamp
 	l := int16(0)
@@ -951,6 +1102,37 @@ func (o *Opal) Output() (int16, int16) {
 		r = int16(rmix)
 	}
 
+	o.tick()
+
+	return l, r
+}
+
+// advance - Run the chip for a sample at the OPL3 sample-rate, the same as Output without mixing.
+func (o *Opal) advance() {
+	for i := range o.Chan {
+		if !o.playing(i) {
+			continue
+		}
+		o.Chan[i].Forward()
+	}
+	if o.RhythmMode {
+		o.rhythmForward()
+	}
+
+	o.tick()
+}
+
+// playing - Whether channel `i` is mixed by Output.  The drums take over channels 6-8 in rhythm mode,
+// and the channels of the second bank are only played in OPL3 mode.
+func (o *Opal) playing(i int) bool {
+	if o.RhythmMode && i >= 6 && i <= 8 {
+		return false
+	}
+	return o.OPL3Mode || i < 9
+}
+
+// tick - Advance the envelope clock and the LFOs by a sample at the OPL3 sample-rate.
+func (o *Opal) tick() {
 	o.Clock++
 
 	// Tremolo.  According to this post, the OPL3 tremolo is a 13,440 sample length triangle wave
@@ -974,8 +1156,6 @@ func (o *Opal) Output() (int16, int16) {
 		o.VibratoTick = 0
 		o.VibratoClock = (o.VibratoClock + 1) & 7
 	}
-
-	return l, r
 }
 
 func (o *Opal) portOperatorRegs(regNum uint16, val uint8) {
@@ -1017,7 +1197,14 @@ func (o *Opal) portOperatorRegs(regNum uint16, val uint8) {
 		op.SetReleaseRate(uint16(val & 15))
 
 	case 0xE0: // Waveform
-		op.SetWaveform(uint16(val & 7))
+		// All 8 waveforms are available in OPL3 mode, OPL2 mode has 4 of them if they're enabled
+		mask := uint8(0)
+		if o.OPL3Mode {
+			mask = 7
+		} else if o.WaveSelect {
+			mask = 3
+		}
+		op.SetWaveform(uint16(val & mask))
 	}
 }
 
@@ -1065,10 +1252,129 @@ func (o *Opal) portChannelRegs(regNum uint16, val uint8) {
 	}
 }
 
+// Drum key-on bits of register BD and the operators they key on: bass drum (both operators of
+// channel 6), snare drum (channel 7 carrier), tom-tom (channel 8 modulator), cymbal (channel 8
+// carrier) and hi-hat (channel 7 modulator)
+var drumOps = [5]struct {
+	mask uint8
+	ops  []int
+}{
+	{0x10, []int{12, 15}},
+	{0x08, []int{16}},
+	{0x04, []int{14}},
+	{0x02, []int{17}},
+	{0x01, []int{13}},
+}
+
+// portRhythm - Switch rhythm mode and key the drums from register BD.  The drums hold their own key
+// on the operators, so the key-on bits of channels 6-8 keep working alongside them.
+func (o *Opal) portRhythm(val uint8) {
+	o.RhythmMode = (val & 0x20) != 0
+	for _, drum := range drumOps {
+		on := o.RhythmMode && (val&drum.mask) != 0
+		for _, op := range drum.ops {
+			o.Op[op].SetKeyOn(on, keyDrum)
+		}
+	}
+}
+
+// rhythmOutput - Produce the output of the drums, which take over channels 6-8 in rhythm mode.
+// Every drum is played at twice the level of a melodic channel and panned with the channel it
+// belongs to: the bass drum with channel 6, hi-hat and snare drum with channel 7, tom-tom and
+// cymbal with channel 8.
+func (o *Opal) rhythmOutput() (int32, int32) {
+	bd, hhsd, ttcy := &o.Chan[6], &o.Chan[7], &o.Chan[8]
+	noiseBit := o.forwardNoise()
+
+	// Bass drum is a regular 2-op channel, only the carrier plays in additive mode
+	vibrato := bd.Vibrato()
+	mod := bd.Op[0].Output(bd.KeyScaleNumber, bd.PhaseStep, vibrato, 0, int16(bd.FeedbackShift))
+	if bd.ModulationType != 0 {
+		mod = 0
+	}
+	bdOut := int32(bd.Op[1].Output(bd.KeyScaleNumber, bd.PhaseStep, vibrato, mod, 0))
+
+	// Tom-tom is a single unmodulated operator
+	vibrato = ttcy.Vibrato()
+	ttOut := int32(ttcy.Op[0].Output(ttcy.KeyScaleNumber, ttcy.PhaseStep, vibrato, 0, 0))
+
+	// Hi-hat, snare drum and cymbal play fixed phases picked by the noise and by a phase bit made
+	// from the phases of the hi-hat and cymbal operators
+	hh, sd, cy := hhsd.Op[0], hhsd.Op[1], ttcy.Op[1]
+	cyLevel, cyOn := cy.Forward(ttcy.PhaseStep, vibrato)
+	vibrato = hhsd.Vibrato()
+	hhLevel, hhOn := hh.Forward(hhsd.PhaseStep, vibrato)
+	sdLevel, sdOn := sd.Forward(hhsd.PhaseStep, vibrato)
+
+	c2 := uint16(hh.Phase >> 10)
+	c5 := uint16(cy.Phase >> 10)
+	phaseBit := uint16(0)
+	if (((c2 & 0x88) ^ ((c2 << 5) & 0x80)) | ((c5 ^ (c5 << 2)) & 0x20)) != 0 {
+		phaseBit = 2
+	}
+
+	hhsdOut := int32(0)
+	if hhOn {
+		hhsdOut += int32(hh.Wave((phaseBit<<8)|(0x34<<(phaseBit^(noiseBit<<1))), hhLevel))
+	}
+	if sdOn {
+		hhsdOut += int32(sd.Wave((0x100+(c2&0x100))^(noiseBit<<8), sdLevel))
+	}
+	ttcyOut := ttOut
+	if cyOn {
+		ttcyOut += int32(cy.Wave((1+phaseBit)<<8, cyLevel))
+	}
+
+	var l, r int32
+	for _, drum := range []struct {
+		ch  *channel
+		out int32
+	}{{bd, bdOut}, {hhsd, hhsdOut}, {ttcy, ttcyOut}} {
+		if drum.ch.LeftEnable {
+			l += drum.out * 2
+		}
+		if drum.ch.RightEnable {
+			r += drum.out * 2
+		}
+	}
+
+	return l, r
+}
+
+// rhythmForward - Advance the drum operators by a sample, the same as rhythmOutput without producing it.
+func (o *Opal) rhythmForward() {
+	o.forwardNoise()
+	for _, ch := range []*channel{&o.Chan[6], &o.Chan[7], &o.Chan[8]} {
+		vibrato := ch.Vibrato()
+		ch.Op[0].Forward(ch.PhaseStep, vibrato)
+		ch.Op[1].Forward(ch.PhaseStep, vibrato)
+	}
+}
+
+// forwardNoise - Clock the noise generator, a 23-bit LFSR that's clocked every sample, and return its
+// output bit.
+func (o *Opal) forwardNoise() uint16 {
+	if (o.Noise & 1) != 0 {
+		o.Noise ^= 0x800302
+	}
+	o.Noise >>= 1
+	return uint16(o.Noise & 1)
+}
+
 func (o *Opal) portGlobalRegs(regNum uint16, val uint8) {
 	switch regNum {
+	case 0x02, 0x03, 0x04: // Timer 1 / Timer 2 / Timer control and IRQ reset
+		o.timers.write(uint32(regNum), val)
+
+	case 0x01: // Test / Waveform select enable
+		o.WaveSelect = (val & 0x20) != 0
+
 	case 0x104: // 4-OP enables
-		o.port104(val)
+		o.Reg104 = val
+		o.port104()
+
+	case 0x105: // OPL3 enable
+		o.port105(val)
 
 	case 0x08: // CSW / Note-sel
 		o.NoteSel = (val & 0x40) != 0
@@ -1079,7 +1385,27 @@ func (o *Opal) portGlobalRegs(regNum uint16, val uint8) {
 	}
 }
 
-func (o *Opal) port104(val uint8) {
+// port105 - Switch between OPL2 and OPL3 mode.  The stereo bits and 4-op enables only apply in
+// OPL3 mode, the waveforms already selected are kept until they're written again.
+func (o *Opal) port105(val uint8) {
+	on := (val & 1) != 0
+	if o.OPL3Mode == on {
+		return
+	}
+	o.OPL3Mode = on
+	for i := range o.Chan {
+		o.Chan[i].ComputeStereo()
+	}
+	o.port104()
+}
+
+func (o *Opal) port104() {
+	// There are no 4-op channels in OPL2 mode
+	val := o.Reg104
+	if !o.OPL3Mode {
+		val = 0
+	}
+
 	// Enable/disable channels based on which 4-op enables
 	mask := uint8(1)
 	for i := 0; i < 6; i++ {
@@ -1108,7 +1434,7 @@ func (o *Opal) port104(val uint8) {
 	}
 }
 
-// NewOpal create a new Opal instance
+// NewOpal create a new Opal instance, it powers on in OPL2 mode like a real OPL3
 func NewOpal(sampleRate uint32) *Opal {
 	o := Opal{}
 	o.Init(int(sampleRate))
@@ -1120,10 +1446,149 @@ func (o *Opal) WriteReg(reg uint32, val uint8) {
 	o.Port(uint16(reg), uint8(val))
 }
 
+// WriteRegChecked is WriteReg, returning an error instead of ignoring writes to unmapped registers
+func (o *Opal) WriteRegChecked(reg uint32, val uint8) error {
+	// The second bank is only mapped in OPL3 mode, apart from the 4-op enables and the register that enables it
+	if !registerMapped(reg, o.OPL3Mode) && reg != RegFourOp && reg != RegOPL3 {
+		return &RegisterError{Reg: reg, Err: ErrUnmappedRegister}
+	}
+	o.WriteReg(reg, val)
+	return nil
+}
+
+// ReadReg returns the value last written to register `reg`
+func (o *Opal) ReadReg(reg uint32) uint8 {
+	return o.regs[reg&0x1FF]
+}
+
+// ReadStatus returns the value of the status register, the same as the one of a YMF262 Chip
+func (o *Opal) ReadStatus() uint8 {
+	return ModelYMF262.StatusBits() | o.timers.status
+}
+
+// SetOnIRQ sets the function called when a timer overflow raises the IRQ, nil disables the callback
+func (o *Opal) SetOnIRQ(handler IRQHandler) {
+	o.onIRQ = handler
+}
+
+// warmup - Amount of output samples at the end of a skip that still get produced, so the interpolation and
+// the operator feedback work from the OPL3 samples that follow the skip.
+func (o *Opal) warmup() uint {
+	native := int64(2)
+	if o.resampler != nil && int64(o.resampler.taps) > native {
+		native = int64(o.resampler.taps)
+	}
+
+	// Output samples covering that many OPL3 samples, plus one for the position of the accumulator
+	period := int64(o.SampleRate) * OPL3ClockDivider
+	return uint((native*period+int64(o.MasterClock)-1)/int64(o.MasterClock)) + 1
+}
+
+// generate runs the Opal for `count` output samples, handing each one to `emit`, or skipping them if it is nil
+// The timers are advanced along, so an IRQ is raised right after the sample where it happens
+func (o *Opal) generate(count uint, emit func(i uint, l, r int16)) {
+	warm := o.warmup()
+	for i := uint(0); i < count; {
+		n := count - i
+		if m := uint(o.timers.samplesUntilOverflow()); m < n {
+			n = m
+		}
+		if emit == nil {
+			// The last samples are still produced, to pick up the interpolation and feedback history
+			for end := i + n; i < end; i++ {
+				if count-i > warm {
+					o.Skip()
+				} else {
+					o.Sample()
+				}
+			}
+		} else {
+			for end := i + n; i < end; i++ {
+				l, r := o.Sample()
+				emit(i, l, r)
+			}
+		}
+		if _, irq := o.timers.advance(uint32(n)); irq && o.onIRQ != nil {
+			o.onIRQ(o.ReadStatus())
+		}
+	}
+}
+
+// Reset returns the Opal to its power-on state, keeping the current sample rate
+func (o *Opal) Reset() {
+	o.Init(int(o.SampleRate))
+}
+
+// GetSampleRate returns the output sample rate of the Opal
+func (o *Opal) GetSampleRate() uint32 {
+	return uint32(o.SampleRate)
+}
+
 // GenerateBlock2 generates a block of mono 16-bit output data from the Opal
+// A nil output advances the Opal by `count` samples without producing them
 func (o *Opal) GenerateBlock2(count uint, output []int32) {
-	for i := uint(0); i < count; i++ {
-		l, r := o.Sample()
+	if output == nil {
+		o.generate(count, nil)
+		return
+	}
+	o.generate(count, func(i uint, l, r int16) {
 		output[i] = (int32(l) + int32(r)) / 2
+	})
+}
+
+// GenerateBlock2Checked is GenerateBlock2, returning an error instead of panicking
+func (o *Opal) GenerateBlock2Checked(count uint, output []int32) error {
+	if output != nil && uint(len(output)) < count {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", count, len(output))
+	}
+	o.GenerateBlock2(count, output)
+	return nil
+}
+
+// GenerateBlock3 generates a block of stereo 16-bit output data from the Opal
+// The output is interleaved as left/right pairs, the same layout as Chip.GenerateBlock3,
+// and keeps the per-channel left/right enables set through register 0xC0
+// A nil output advances the Opal by `count` samples without producing them
+func (o *Opal) GenerateBlock3(count uint, output []int32) {
+	if output == nil {
+		o.generate(count, nil)
+		return
 	}
+	o.generate(count, func(i uint, l, r int16) {
+		output[i*2+0] = int32(l)
+		output[i*2+1] = int32(r)
+	})
+}
+
+// GenerateBlock3Checked is GenerateBlock3, returning an error instead of panicking
+func (o *Opal) GenerateBlock3Checked(count uint, output []int32) error {
+	if output != nil && uint(len(output)) < count*2 {
+		return errors.Wrapf(ErrOutputTooSmall, "%d samples requested, room for %d", count, len(output)/2)
+	}
+	o.GenerateBlock3(count, output)
+	return nil
+}
+
+// GenerateBlock2Float generates a block of normalized mono output data from the Opal (see FloatScale)
+func (o *Opal) GenerateBlock2Float(count uint, output []float32) {
+	if err := o.GenerateBlock2FloatChecked(count, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock2FloatChecked is GenerateBlock2Float, returning an error instead of panicking
+func (o *Opal) GenerateBlock2FloatChecked(count uint, output []float32) error {
+	return generateFloat(count, 1, output, &o.floatBuf, o.GenerateBlock2Checked)
+}
+
+// GenerateBlock3Float generates a block of normalized interleaved stereo output data from the Opal (see FloatScale)
+func (o *Opal) GenerateBlock3Float(count uint, output []float32) {
+	if err := o.GenerateBlock3FloatChecked(count, output); err != nil {
+		panic(err)
+	}
+}
+
+// GenerateBlock3FloatChecked is GenerateBlock3Float, returning an error instead of panicking
+func (o *Opal) GenerateBlock3FloatChecked(count uint, output []float32) error {
+	return generateFloat(count, 2, output, &o.floatBuf, o.GenerateBlock3Checked)
 }
@@ -28,12 +28,9 @@ package opl2
 	The generation was based on the MAME implementation but tried to have it use less memory and be faster in general
 	MAME uses much bigger envelope tables and this will be the biggest cause of it sounding different at times
 
-	//TODO Don't delay first operator 1 sample in opl3 mode
 	//TODO Maybe not use class method pointers but a regular function pointers with operator as first parameter
-	//TODO Fix panning for the Percussion channels, would any opl3 player use it and actually really change it though?
 	//TODO Check if having the same accuracy in all frequency multipliers sounds better or not
 
-	//DUNNO Keyon in 4op, switch to 2op without keyoff.
 */
 
 //Masks for operator 20 values
@@ -66,12 +63,15 @@ type volumeHandler func() int
 type Operator struct {
 	volHandler volumeHandler
 
-	waveHandler waveHandler //Routine that generate a wave
+	waveHandler waveHandler   //Routine that generate a wave
+	waveGen     WaveGenerator //Type of wave generator routine, selected by the chip
 
 	waveBase  []int16
 	waveMask  int
 	waveStart int
 
+	waveSh      uint8 //Shift of the wave counters, depends on the wave precision of the chip
+	precision   uint8
 	waveIndex   int //WAVE_BITS shifted counter of the frequency index
 	waveAdd     int //The base frequency without vibrato
 	waveCurrent int //waveAdd + vibratao
@@ -89,6 +89,11 @@ type Operator struct {
 	releaseAdd uint32
 	rateIndex  uint32 //Current position of the evenlope
 
+	exactEnvelope bool   //Step the envelope with the envelope clock of the chip, see WithExactEnvelope
+	egClock       uint32 //Copy of the envelope clock of the chip, synced in Prepare
+	egAcc         uint32 //Fraction of the next tick of the envelope clock
+	egAdd         uint32 //Ticks of the envelope clock per sample
+
 	rateZero uint8 //int for the different states of the envelope having no changes
 	keyOn    uint8 //Bitmask of different values that can generate keyon
 	//Registers, also used to check for changes
@@ -179,11 +184,22 @@ func (o *Operator) UpdateAttenuation() {
 	o.totalLevel += baseShift >> kslShift
 }
 
+// SetPrecision selects the wave precision of the operator, it has to match the one of its chip
+func (o *Operator) SetPrecision(precision uint8) {
+	o.precision = precision
+	o.waveSh = waveShift(precision)
+}
+
+// SetExactEnvelope selects the exact envelope mode of the operator, it has to match the one of its chip
+func (o *Operator) SetExactEnvelope(enabled bool) {
+	o.exactEnvelope = enabled
+}
+
 // UpdateFrequency updates the frequency on the operator
 func (o *Operator) UpdateFrequency() {
 	freq := uint32(o.chanData & ((1 << 10) - 1))
 	block := uint32((o.chanData >> 10) & 0xff)
-	if cWavePrecision != 0 {
+	if o.precision != 0 {
 		block = 7 - block
 		o.waveAdd = int(freq*o.freqMul) >> block
 	} else {
@@ -192,7 +208,7 @@ func (o *Operator) UpdateFrequency() {
 	if (o.reg20 & cMaskVibrato) != 0 {
 		o.vibStrength = (uint8)(freq >> 7)
 
-		if cWavePrecision != 0 {
+		if o.precision != 0 {
 			o.vibrato = (uint32(o.vibStrength) * o.freqMul) >> block
 		} else {
 			o.vibrato = (uint32(o.vibStrength) << block) * o.freqMul
@@ -230,13 +246,16 @@ func (o *Operator) RateForward(add uint32) int32 {
 
 // ForwardVolume updates the operator's current volume
 func (o *Operator) ForwardVolume() int {
+	if o.exactEnvelope {
+		return o.currentLevel + o.forwardExactEnvelope()
+	}
 	return o.currentLevel + o.volHandler()
 }
 
 // ForwardWave updates the operator's current waveform
 func (o *Operator) ForwardWave() uint {
 	o.waveIndex += o.waveCurrent
-	return uint(o.waveIndex) >> cWaveSh
+	return uint(o.waveIndex) >> o.waveSh
 }
 
 // Write20 writes data to register 0x20 on the operator
@@ -305,17 +324,24 @@ func (o *Operator) Write80(chip *Chip, val uint8) {
 
 // WriteE0 writes data to register 0xE0 on the operator
 func (o *Operator) WriteE0(chip *Chip, val uint8) {
-	if (o.regE0 ^ val) != 0 {
+	if (o.regE0 ^ val) == 0 {
 		return
 	}
 	//in opl3 mode you can always selet 7 waveforms regardless of waveformselect
 	waveForm := uint8(val & (uint8(0x3&chip.waveFormMask) | (0x7 & uint8(chip.opl3Active))))
 	o.regE0 = val
-	if cDBOPLWave == cWaveHandler {
+	o.waveGen = chip.wave
+	switch o.waveGen {
+	case WaveGeneratorHandler:
 		o.waveHandler = waveHandlerTable[waveForm]
-	} else {
-		o.waveBase = cWaveTable[cWaveBaseTable[waveForm]:]
-		o.waveStart = int(cWaveStartTable[waveForm]) << cWaveSh
+		o.waveStart = 0
+	case WaveGeneratorTableLog:
+		o.waveBase = cLogWaveTable[cWaveBaseTable[waveForm]:]
+		o.waveStart = int(cWaveStartTable[waveForm]) << o.waveSh
+		o.waveMask = int(cWaveMaskTable[waveForm])
+	default:
+		o.waveBase = cMulWaveTable[cWaveBaseTable[waveForm]:]
+		o.waveStart = int(cWaveStartTable[waveForm]) << o.waveSh
 		o.waveMask = int(cWaveMaskTable[waveForm])
 	}
 }
@@ -401,6 +427,95 @@ func (o *Operator) volHandlerATTACK() int {
 	return int(vol)
 }
 
+// envelopeRate returns the 6 bit rate of an envelope stage for its 4 bit register value `rate`
+func (o *Operator) envelopeRate(rate uint8) uint8 {
+	if rate == 0 {
+		return 0
+	}
+	val := (rate << 2) + o.ksr
+	if val > 63 {
+		val = 63
+	}
+	return val
+}
+
+// envelopeIncrement returns the step of an envelope at the 6 bit `rate` on tick `clock` of the envelope clock
+//The low 2 bits of the rate select one of the 8 step increment patterns, the high 4 bits how often it's stepped
+func envelopeIncrement(rate uint8, clock uint32) int32 {
+	rateHi := rate >> 2
+	if rateHi == 0 {
+		return 0
+	}
+	pattern := &opalRateTables[rate&3]
+	if rateHi < 12 {
+		shift := uint(12 - rateHi)
+		if (clock & ((1 << shift) - 1)) != 0 {
+			return 0
+		}
+		return int32(1 >> pattern[(clock>>shift)&7])
+	}
+	return int32((1 << (rateHi - 12)) >> pattern[clock&7])
+}
+
+// forwardExactEnvelope runs the envelope for the ticks of the envelope clock that fall within the next sample
+func (o *Operator) forwardExactEnvelope() int {
+	o.egAcc += o.egAdd
+	for o.egAcc >= (1 << cEnvClockSh) {
+		o.egAcc -= 1 << cEnvClockSh
+		o.clockEnvelope(o.egClock)
+		o.egClock++
+	}
+	if o.state == OperatorStateOff {
+		return cEnvMax
+	}
+	return int(o.volume)
+}
+
+// clockEnvelope steps the envelope once, for tick `clock` of the envelope clock
+func (o *Operator) clockEnvelope(clock uint32) {
+	vol := o.volume
+	switch o.state {
+	case OperatorStateAttack:
+		rate := o.envelopeRate(o.reg60 >> 4)
+		if rate >= 60 {
+			//Attack rate 15 reaches max volume right away
+			vol = cEnvMin
+		} else if change := envelopeIncrement(rate, clock); change != 0 {
+			vol += (^vol * change) >> 3
+		}
+		if vol <= cEnvMin {
+			vol = cEnvMin
+			o.SetState(OperatorStateDecay)
+		}
+	case OperatorStateDecay:
+		vol += envelopeIncrement(o.envelopeRate(o.reg60&0xf), clock)
+		if vol >= o.sustainLevel {
+			if vol >= cEnvMax {
+				vol = cEnvMax
+				o.SetState(OperatorStateOff)
+			} else {
+				o.SetState(OperatorStateSustain)
+			}
+		}
+	case OperatorStateSustain, OperatorStateRelease:
+		//In sustain phase, but not sustaining, do regular release
+		if o.state == OperatorStateSustain {
+			if (o.reg20 & cMaskSustain) != 0 {
+				return
+			}
+			o.SetState(OperatorStateRelease)
+		}
+		vol += envelopeIncrement(o.envelopeRate(o.reg80&0xf), clock)
+		if vol >= cEnvMax {
+			vol = cEnvMax
+			o.SetState(OperatorStateOff)
+		}
+	default:
+		return
+	}
+	o.volume = vol
+}
+
 // Silent returns true if the operator is currently silent
 func (o *Operator) Silent() bool {
 	if !envSilent(int(o.totalLevel + o.volume)) {
@@ -416,6 +531,12 @@ func (o *Operator) Silent() bool {
 func (o *Operator) Prepare(chip *Chip) {
 	o.currentLevel = int(o.totalLevel) + int(chip.tremoloValue&o.tremoloMask)
 	o.waveCurrent = o.waveAdd
+	if o.exactEnvelope {
+		//Every operator runs a copy of the envelope clock during a block, the chip forwards its own afterwards
+		o.egClock = chip.egClock
+		o.egAcc = chip.egAcc
+		o.egAdd = chip.egAdd
+	}
 	if (o.vibStrength >> chip.vibratoShift) != 0 {
 		add := int(o.vibrato) >> chip.vibratoShift
 		//Sign extend over the shift value
@@ -430,12 +551,8 @@ func (o *Operator) Prepare(chip *Chip) {
 // KeyOn updates the key-on state of the operator to true
 func (o *Operator) KeyOn(mask uint8) {
 	if o.keyOn == 0 {
-		//Restart the frequency generator
-		if cDBOPLWave > cWaveHandler {
-			o.waveIndex = o.waveStart
-		} else {
-			o.waveIndex = 0
-		}
+		//Restart the frequency generator, the wave handlers always start at 0
+		o.waveIndex = o.waveStart
 		o.rateIndex = 0
 		o.SetState(OperatorStateAttack)
 	}
@@ -454,15 +571,15 @@ func (o *Operator) KeyOff(mask uint8) {
 
 // GetWave gets the current waveform of the operator
 func (o *Operator) GetWave(index uint, vol int) int {
-	if cDBOPLWave == cWaveHandler {
+	if o.waveGen == WaveGeneratorHandler {
 		return o.waveHandler(index, vol<<(3-cEnvExtra))
-	} else if cDBOPLWave == cWaveTableMul {
+	} else if o.waveGen == WaveGeneratorTableMul {
 		wb := o.waveBase[index&uint(o.waveMask)]
 		base := int(wb)
 		mul := int(cMulTable[vol>>cEnvExtra])
 		val := (base * mul) >> cMulSh
 		return val
-	} else if cDBOPLWave == cWaveTableLog {
+	} else if o.waveGen == WaveGeneratorTableLog {
 		wave := int32(o.waveBase[index&uint(o.waveMask)])
 		total := uint32(int(wave&0x7fff) + vol<<(3-cEnvExtra))
 		sig := int32(cExpTable[total&0xff])
@@ -30,12 +30,9 @@ import "math"
 	The generation was based on the MAME implementation but tried to have it use less memory and be faster in general
 	MAME uses much bigger envelope tables and this will be the biggest cause of it sounding different at times
 
-	//TODO Don't delay first operator 1 sample in opl3 mode
 	//TODO Maybe not use class method pointers but a regular function pointers with operator as first parameter
-	//TODO Fix panning for the Percussion channels, would any opl3 player use it and actually really change it though?
 	//TODO Check if having the same accuracy in all frequency multipliers sounds better or not
 
-	//DUNNO Keyon in 4op, switch to 2op without keyoff.
 */
 
 const (
@@ -56,10 +53,11 @@ const (
 
 	//Try to use most precision for frequencies
 	//Else try to keep different waves in synch
+	//This is the default, a chip can select the high precision when it is created
 	//cWavePrecision = 1
 	cWavePrecision = 0
 
-	//Select the type of wave generator routine
+	//Default type of wave generator routine, a chip can select another one when it is created
 	cDBOPLWave = cWaveTableMul
 
 	//cWavePrecision = 1:
@@ -71,12 +69,6 @@ const (
 	//  Original adlib uses 10.10, we use 10.22
 	cWaveBits = 10 + int(cWavePrecision)*4
 	cWaveSh   = 32 - cWaveBits
-	cWaveMask = (1 << cWaveSh) - 1
-
-	//Use the same accuracy as the waves
-	cLFOSh = cWaveSh - 10
-	//LFO is controlled by our tremolo 256 sample limit
-	cLFOMax = 256 << cLFOSh
 
 	//Maximum amount of attenuation bits
 	//Envelope goes to 511, 9 bits
@@ -88,6 +80,16 @@ const (
 	cEnvLimit = (12 * 256) >> (3 - cEnvExtra)
 )
 
+//Shift of the wave counters for the wave precision `precision` (see cWavePrecision)
+func waveShift(precision uint8) uint8 {
+	return uint8(32 - (10 + int(precision)*4))
+}
+
+//Shift of the lfo and noise counters, they use the same accuracy as the waves
+func lfoShift(precision uint8) uint8 {
+	return waveShift(precision) - 10
+}
+
 func envSilent(x int) bool {
 	return x >= cEnvLimit
 }
@@ -96,6 +98,9 @@ const (
 	//Attack/decay/release rate counter shift
 	cRateSh   = 24
 	cRateMask = (1 << cRateSh) - 1
+	//Fraction bits of the envelope clock ticks per sample in the exact envelope mode
+	cEnvClockSh   = 16
+	cEnvClockMask = (1 << cEnvClockSh) - 1
 	//Has to fit within 16bit lookuptable
 	cMulSh = 16
 )
@@ -155,7 +160,11 @@ var cSinTable = make([]uint16, 512)
 
 //6 is just 0 shifted and masked
 
-var cWaveTable = make([]int16, 8*512)
+//Linear wavetable used by WAVETABLEMUL
+var cMulWaveTable = make([]int16, 8*512)
+
+//Logarithmic wavetable used by WAVETABLELOG
+var cLogWaveTable = make([]int16, 8*512)
 
 //Distance into WaveTable the wave starts
 var cWaveBaseTable = [8]uint16{
@@ -236,7 +245,7 @@ func waveForm0(i uint, volume int) int {
 
 func waveForm1(i uint, volume int) int {
 	wave := int(cSinTable[i&511])
-	wave |= (((int(i) ^ 512) & 512) - 1) >> (32 - 12)
+	wave |= int((uint32((i^512)&512) - 1) >> (32 - 12))
 	return makeVolume(wave, volume)
 }
 
@@ -247,7 +256,7 @@ func waveForm2(i uint, volume int) int {
 
 func waveForm3(i uint, volume int) int {
 	wave := int(cSinTable[i&255])
-	wave |= (((int(i) ^ 256) & 256) - 1) >> (32 - 12)
+	wave |= int((uint32((i^256)&256) - 1) >> (32 - 12))
 	return makeVolume(wave, volume)
 }
 
@@ -256,7 +265,7 @@ func waveForm4(i uint, volume int) int {
 	i <<= 1
 	neg := int(0 - ((i >> 9) & 1)) //Create ~0 or 0
 	wave := int(cSinTable[i&511])
-	wave |= (((int(i) ^ 512) & 512) - 1) >> (32 - 12)
+	wave |= int((uint32((i^1024)&1024) - 1) >> (32 - 12))
 	return (makeVolume(wave, volume) ^ neg) - neg
 }
 
@@ -264,7 +273,7 @@ func waveForm5(i uint, volume int) int {
 	//Twice as fast
 	i <<= 1
 	wave := int(cSinTable[i&511])
-	wave |= (((int(i) ^ 512) & 512) - 1) >> (32 - 12)
+	wave |= int((uint32((i^1024)&1024) - 1) >> (32 - 12))
 	return makeVolume(wave, volume)
 }
 func waveForm6(i uint, volume int) int {
@@ -288,83 +297,70 @@ var waveHandlerTable = [8]waveHandler{
 }
 
 func init() {
-	if cDBOPLWave == cWaveHandler || cDBOPLWave == cWaveTableLog {
-		//Exponential volume table, same as the real adlib
-		for i := 0; i < 256; i++ {
-			//Save them in reverse
-			exp := float64(255-i) / 256.0
-			p := math.Pow(2.0, exp) - 1
-			expVal := uint16(math.Round(p * 1024))
-			expVal += 1024 //or remove the -1 oh well :)
-			//Preshift to the left once so the final volume can shift to the right
-			cExpTable[i] = expVal * 2
-			//ExpTable[i] *= 2
-		}
+	//Every wave generator routine can be selected at runtime, so the tables of all of them are created
+
+	//Exponential volume table, same as the real adlib
+	for i := 0; i < 256; i++ {
+		//Save them in reverse
+		exp := float64(255-i) / 256.0
+		p := math.Pow(2.0, exp) - 1
+		expVal := uint16(math.Round(p * 1024))
+		expVal += 1024 //or remove the -1 oh well :)
+		//Preshift to the left once so the final volume can shift to the right
+		cExpTable[i] = expVal * 2
+		//ExpTable[i] *= 2
 	}
 
-	if cDBOPLWave == cWaveHandler {
-		//Add 0.5 for the trunc rounding of the integer cast
-		//Do a PI sinetable instead of the original 0.5 PI
-		piPiece := math.Pi / 512.0
-		for i := 0; i < 512; i++ {
-			a := 0.5 - math.Log2(math.Sin((float64(i)+0.5)*piPiece))*256
-			cSinTable[i] = uint16(a)
-		}
+	//Add 0.5 for the trunc rounding of the integer cast
+	//Do a PI sinetable instead of the original 0.5 PI
+	piPiece := math.Pi / 512.0
+	for i := 0; i < 512; i++ {
+		a := 0.5 - math.Log2(math.Sin((float64(i)+0.5)*piPiece))*256
+		cSinTable[i] = uint16(a)
 	}
 
-	if cDBOPLWave == cWaveTableMul {
-		//Multiplication based tables
-		for i := 0; i < 384; i++ {
-			s := int(i * 8)
-			//TODO maybe keep some of the precision errors of the original table?
-			val := float64((0.5 + (math.Pow(2.0, -1.0+float64(255-s)*(1.0/256)))*(1<<cMulSh)))
-			cMulTable[i] = uint16(val)
-		}
-
-		//Sine Wave Base
-		for i := 0; i < 512; i++ {
-			cWaveTable[0x0200+i] = int16((math.Sin((float64(i)+0.5)*(math.Pi/512.0)) * 4084))
-			cWaveTable[0x0000+i] = -cWaveTable[0x200+i]
-		}
-		//Exponential wave
-		for i := 0; i < 256; i++ {
-			cWaveTable[0x700+i] = int16((0.5 + (math.Pow(2.0, -1.0+float64(255-i*8)*(1.0/256)))*4085))
-			cWaveTable[0x6ff-i] = -cWaveTable[0x700+i]
-		}
+	//Multiplication based tables
+	for i := 0; i < 384; i++ {
+		s := int(i * 8)
+		//TODO maybe keep some of the precision errors of the original table?
+		val := float64((0.5 + (math.Pow(2.0, -1.0+float64(255-s)*(1.0/256)))*(1<<cMulSh)))
+		cMulTable[i] = uint16(val)
 	}
 
-	if cDBOPLWave == cWaveTableLog {
-		//Sine Wave Base
-		for i := 0; i < 512; i++ {
-			cWaveTable[0x0200+i] = int16((0.5 - math.Log10(math.Sin((float64(i)+0.5)*(math.Pi/512.0)))/math.Log10(2.0)*256))
-			cWaveTable[0x0000+i] = int16((uint16(0x8000) | uint16(cWaveTable[0x200+i])))
-		}
-		//Exponential wave
-		for i := 0; i < 256; i++ {
-			cWaveTable[0x700+i] = int16(i * 8)
-			cWaveTable[0x6ff-i] = int16(0x8000 | i*8)
-		}
+	//Sine Wave Base
+	for i := 0; i < 512; i++ {
+		cMulWaveTable[0x0200+i] = int16((math.Sin((float64(i)+0.5)*(math.Pi/512.0)) * 4084))
+		cMulWaveTable[0x0000+i] = -cMulWaveTable[0x200+i]
+		cLogWaveTable[0x0200+i] = int16((0.5 - math.Log10(math.Sin((float64(i)+0.5)*(math.Pi/512.0)))/math.Log10(2.0)*256))
+		cLogWaveTable[0x0000+i] = int16((uint16(0x8000) | uint16(cLogWaveTable[0x200+i])))
+	}
+	//Exponential wave
+	for i := 0; i < 256; i++ {
+		cMulWaveTable[0x700+i] = int16((0.5 + (math.Pow(2.0, -1.0+float64(255-i*8)*(1.0/256)))*4085))
+		cMulWaveTable[0x6ff-i] = -cMulWaveTable[0x700+i]
+		cLogWaveTable[0x700+i] = int16(i * 8)
+		cLogWaveTable[0x6ff-i] = int16(0x8000 | i*8)
 	}
 
 	//	|    |//\\|____|WAV7|//__|/\  |____|/\/\|
 	//	|\\//|    |    |WAV7|    |  \/|    |    |
 	//	|06  |0126|27  |7   |3   |4   |4 5 |5   |
 
-	if cDBOPLWave == cWaveTableLog || cDBOPLWave == cWaveTableMul {
+	for _, waveTable := range [][]int16{cMulWaveTable, cLogWaveTable} {
 		for i := 0; i < 256; i++ {
 			//Fill silence gaps
-			cWaveTable[0x400+i] = cWaveTable[0]
-			cWaveTable[0x500+i] = cWaveTable[0]
-			cWaveTable[0x900+i] = cWaveTable[0]
-			cWaveTable[0xc00+i] = cWaveTable[0]
-			cWaveTable[0xd00+i] = cWaveTable[0]
+			waveTable[0x400+i] = waveTable[0]
+			waveTable[0x500+i] = waveTable[0]
+			waveTable[0x900+i] = waveTable[0]
+			waveTable[0xc00+i] = waveTable[0]
+			waveTable[0xd00+i] = waveTable[0]
 			//Replicate sines in other pieces
-			cWaveTable[0x800+i] = cWaveTable[0x200+i]
+			waveTable[0x800+i] = waveTable[0x200+i]
 			//float64 speed sines
-			cWaveTable[0xa00+i] = cWaveTable[0x200+i*2]
-			cWaveTable[0xb00+i] = cWaveTable[0x000+i*2]
-			cWaveTable[0xe00+i] = cWaveTable[0x200+i*2]
-			cWaveTable[0xf00+i] = cWaveTable[0x200+i*2]
+			waveTable[0xa00+i] = waveTable[0x200+i*2]
+			waveTable[0xb00+i] = waveTable[0x000+i*2]
+			waveTable[0xe00+i] = waveTable[0x200+i*2]
+			waveTable[0xf00+i] = waveTable[0x200+i*2]
 		}
 	}
 
@@ -22,7 +22,7 @@ var (
 	errOPL3ChipNotDetected = errors.New("opl3 chip not detected")
 )
 
-func detectChip(c *opl2.Chip) error {
+func detectChip(c opl2.Emulator) error {
 	// Reset both timers
 	c.WriteReg(0x04, 0x60)
 	// Enable the interrupts
@@ -39,7 +39,7 @@ func detectChip(c *opl2.Chip) error {
 	// Start Timer 1
 	c.WriteReg(0x04, 0x21)
 	// Delay for at least 80 microseconds, simulated by generating 80us of data
-	dataLen := math.Round((time.Microsecond * 80).Seconds() * float64(sampleRate))
+	dataLen := math.Ceil((time.Microsecond * 80).Seconds() * float64(sampleRate))
 	c.GenerateBlock2(uint(dataLen), nil)
 	// Read status value
 	status2 := c.ReadStatus()
@@ -56,7 +56,7 @@ func detectChip(c *opl2.Chip) error {
 	return nil
 }
 
-func detectOPLVersion(c *opl2.Chip, opl3Expected bool) error {
+func detectOPLVersion(c opl2.Emulator, opl3Expected bool) error {
 	if err := detectChip(c); err != nil {
 		return err
 	}
@@ -92,6 +92,12 @@ func TestDetectOPL2WithOPL3(t *testing.T) {
 	}
 }
 
+func TestDetectOPL3WithOpal(t *testing.T) {
+	if err := detectOPLVersion(opl2.NewOpal(uint32(sampleRate)), true); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestResetOPL2(t *testing.T) {
 	if err := detectChip(ym3812); err != nil {
 		t.Error(err)
@@ -108,8 +114,41 @@ func TestMain(m *testing.M) {
 	flag.UintVar(&sampleRate, "s", uint(math.Round(opl2.OPLRATE)), "sample rate for OPL2/3 devices")
 	flag.Parse()
 
-	ym3812 = opl2.NewChip(uint32(sampleRate), false)
-	ymf262 = opl2.NewChip(uint32(sampleRate), true)
+	var err error
+	if ym3812, err = opl2.NewChip(uint32(sampleRate), opl2.WithModel(opl2.ModelYM3812)); err != nil {
+		panic(err)
+	}
+	if ymf262, err = opl2.NewChip(uint32(sampleRate), opl2.WithModel(opl2.ModelYMF262)); err != nil {
+		panic(err)
+	}
 
 	os.Exit(m.Run())
 }
+
+func TestDetectOPLVersion(t *testing.T) {
+	for _, tc := range []struct {
+		model opl2.Model
+		new   uint8
+		opl3  bool
+	}{
+		{opl2.ModelYM3526, 0x00, false},
+		{opl2.ModelYM3812, 0x00, false},
+		{opl2.ModelYMF262, 0x00, true},
+		{opl2.ModelYMF262, 0x01, true},
+	} {
+		c, err := opl2.NewChip(uint32(sampleRate), opl2.WithModel(tc.model))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteReg(0x105, tc.new)
+		if status := c.ReadStatus(); status != tc.model.StatusBits() {
+			t.Errorf("%v with NEW=%d: expected power-on status of %0.2X, got %0.2X", tc.model, tc.new, tc.model.StatusBits(), status)
+		}
+		if err := detectOPLVersion(c, tc.opl3); err != nil {
+			t.Errorf("%v with NEW=%d: %v", tc.model, tc.new, err)
+		}
+		if status := c.ReadStatus(); status != tc.model.StatusBits() {
+			t.Errorf("%v with NEW=%d: expected status of %0.2X after the IRQ reset, got %0.2X", tc.model, tc.new, tc.model.StatusBits(), status)
+		}
+	}
+}
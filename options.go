@@ -0,0 +1,213 @@
+package opl2
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Model is a Yamaha FM synthesis chip that can be emulated by Chip
+type Model int
+
+const (
+	// ModelYM3526 is the OPL, the YM3812 without the waveform select
+	ModelYM3526 = Model(iota)
+	// ModelYM3812 is the OPL2, as found on the AdLib and early Sound Blaster cards
+	ModelYM3812
+	// ModelYMF262 is the OPL3, with a second register bank, 4-op channels and stereo output
+	ModelYMF262
+)
+
+func (m Model) String() string {
+	switch m {
+	case ModelYM3526:
+		return "YM3526"
+	case ModelYM3812:
+		return "YM3812"
+	case ModelYMF262:
+		return "YMF262"
+	}
+	return "unknown"
+}
+
+// DefaultClock returns the nominal master clock of the model in Hz
+func (m Model) DefaultClock() uint32 {
+	if m == ModelYMF262 {
+		return 14318180
+	}
+	return 3579545
+}
+
+// StatusBits returns the bits of the status register that don't hold a flag, as the model drives them
+// The YM3526 and YM3812 read 0x06 in the unused low bits, the YMF262 reads 0x00 in both opl2 and opl3 mode,
+// which is what software checks to tell an OPL3 from an OPL2
+func (m Model) StatusBits() uint8 {
+	if m.isOPL3() {
+		return 0x00
+	}
+	return statusOPL2Bits
+}
+
+func (m Model) isOPL3() bool {
+	return m == ModelYMF262
+}
+
+// WaveGenerator is a wave generation routine used by Chip
+type WaveGenerator int
+
+const (
+	// WaveGeneratorHandler uses 8 handlers based on a small logarithmic wavetable and an exponential table for volume
+	WaveGeneratorHandler = WaveGenerator(cWaveHandler)
+	// WaveGeneratorTableLog uses a logarithmic wavetable with an exponential table for volume
+	WaveGeneratorTableLog = WaveGenerator(cWaveTableLog)
+	// WaveGeneratorTableMul uses a linear wavetable with a multiply table for volume
+	WaveGeneratorTableMul = WaveGenerator(cWaveTableMul)
+)
+
+// OutputConversion is the conversion applied to the integer output of Chip
+type OutputConversion int
+
+const (
+	// OutputRaw leaves the output unclipped
+	OutputRaw = OutputConversion(iota)
+	// OutputClip16 clamps the output to the range of a signed 16-bit sample
+	OutputClip16
+)
+
+type chipConfig struct {
+	model  Model
+	wave   WaveGenerator
+	clock  uint32
+	output OutputConversion
+	onIRQ  IRQHandler
+
+	accurateTiming bool
+	precision      uint8
+	exactEnvelope  bool
+}
+
+// ChipOption configures a Chip created by NewChip
+type ChipOption func(cfg *chipConfig) error
+
+// WithModel selects the chip model, the default is ModelYM3812
+func WithModel(model Model) ChipOption {
+	return func(cfg *chipConfig) error {
+		switch model {
+		case ModelYM3526, ModelYM3812, ModelYMF262:
+		default:
+			return errors.Wrapf(ErrUnsupportedOption, "model %d", model)
+		}
+		cfg.model = model
+		return nil
+	}
+}
+
+// WithWaveGenerator selects the wave generation routine, the default is WaveGeneratorTableMul
+// WaveGeneratorTableLog and WaveGeneratorHandler use the logarithmic sine and exponential tables of the real chip
+func WithWaveGenerator(wave WaveGenerator) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.wave = wave
+		return nil
+	}
+}
+
+// WithClock sets the master clock of the chip in Hz, the default is the nominal clock of the model
+// (3.579545 MHz for the YM3526 and YM3812, 14.31818 MHz for the YMF262)
+// A clock so slow that the internal sample rate falls below an eighth of the output rate is not supported
+func WithClock(clock uint32) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.clock = clock
+		return nil
+	}
+}
+
+// WithOutputConversion selects the conversion applied to the integer output, the default is OutputRaw
+func WithOutputConversion(output OutputConversion) ChipOption {
+	return func(cfg *chipConfig) error {
+		switch output {
+		case OutputRaw, OutputClip16:
+		default:
+			return errors.Wrapf(ErrUnsupportedOption, "output conversion %d", output)
+		}
+		cfg.output = output
+		return nil
+	}
+}
+
+// WithOnIRQ sets the function called when a timer overflow raises the IRQ, see IRQHandler
+func WithOnIRQ(handler IRQHandler) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.onIRQ = handler
+		return nil
+	}
+}
+
+// WithAccurateTiming removes the delay of the first operator in opl3 mode, the default is false
+// By default the second operator of a channel is modulated by the output of the first operator one sample late,
+// as in the original DOSBox emulator. With accurate timing the output of the same sample is used, as on a real
+// YMF262, which changes the sound of phase-sensitive patches. Both the modulation and the AM mixing of the first
+// operator are affected, as well as the bass drum. The opl2 mode is not affected, so the option is rejected
+// for the models without an opl3 mode.
+func WithAccurateTiming(enabled bool) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.accurateTiming = enabled
+		return nil
+	}
+}
+
+// WithHighPrecision selects the high precision frequency mode, the default is false
+// The wave counters then keep 4 more bits for the frequency, which avoids the pitch drift of the
+// default mode at low output rates. The phase of waves playing at different frequencies drifts apart
+// a little more in exchange. The wave counters have less headroom for the frequency, so the mode
+// is rejected below about 5.8 kHz at the nominal clock.
+func WithHighPrecision(enabled bool) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.precision = 0
+		if enabled {
+			cfg.precision = 1
+		}
+		return nil
+	}
+}
+
+// WithExactEnvelope selects the exact envelope mode, the default is false
+// By default the envelopes step by rate-scaled increments every sample and the attack curves are fitted
+// to the timing of the real chip. In the exact mode all envelopes follow the global envelope clock of the
+// real chip at its internal sample rate, with the same increment patterns, so attacks and decays match the
+// hardware step for step. Percussive patches sound closer to the real chip, at a small cost in speed.
+func WithExactEnvelope(enabled bool) ChipOption {
+	return func(cfg *chipConfig) error {
+		cfg.exactEnvelope = enabled
+		return nil
+	}
+}
+
+// validate checks that the combination of options is supported
+func (cfg *chipConfig) validate(rate uint32) error {
+	if rate == 0 {
+		return ErrInvalidSampleRate
+	}
+	switch cfg.wave {
+	case WaveGeneratorHandler, WaveGeneratorTableLog, WaveGeneratorTableMul:
+	default:
+		return errors.Wrapf(ErrUnsupportedOption, "wave generator %d", cfg.wave)
+	}
+	if cfg.clock == 0 {
+		cfg.clock = cfg.model.DefaultClock()
+	}
+	if err := checkRateScale(cfg.model, cfg.clock, rate); err != nil {
+		return err
+	}
+	//The first operator is only delayed in opl3 mode, which the other models don't have
+	if cfg.accurateTiming && !cfg.model.isOPL3() {
+		return errors.Wrapf(ErrUnsupportedOption, "accurate timing on the %v", cfg.model)
+	}
+	//The frequency of the operators is multiplied into a 32-bit wave counter increment
+	if cfg.precision != 0 {
+		freqMul := freqMulTable(cfg.precision, rateScale(cfg.model, cfg.clock, rate))
+		if uint64(freqMul[15])*((1<<10)-1) > math.MaxUint32 {
+			return errors.Wrapf(ErrUnsupportedOption, "high precision at %d Hz with a %d Hz clock", rate, cfg.clock)
+		}
+	}
+	return nil
+}
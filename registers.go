@@ -0,0 +1,389 @@
+package opl2
+
+import "github.com/pkg/errors"
+
+// Register addresses of the OPL2/3 register file
+// The operator and channel registers are bases, see OperatorRegAddr and ChannelRegAddr
+const (
+	RegWaveSelect       = 0x01  // Test / waveform select enable
+	RegTimer1           = 0x02  // Timer 1 preset (80us resolution)
+	RegTimer2           = 0x03  // Timer 2 preset (320us resolution)
+	RegTimerControl     = 0x04  // IRQ reset / timer masks / timer start
+	RegMode             = 0x08  // CSW mode / note select
+	RegOpFlags          = 0x20  // Tremolo / vibrato / sustain / KSR / frequency multiplier
+	RegOpLevel          = 0x40  // Key scale level / total level
+	RegOpAttackDecay    = 0x60  // Attack rate / decay rate
+	RegOpSustainRelease = 0x80  // Sustain level / release rate
+	RegChFreqLow        = 0xA0  // Frequency number, low 8 bits
+	RegChFreqHigh       = 0xB0  // Key-on / block / frequency number, high 2 bits
+	RegRhythm           = 0xBD  // Tremolo depth / vibrato depth / rhythm mode and drum key-ons
+	RegChFeedback       = 0xC0  // Output enables / feedback / connection
+	RegOpWaveform       = 0xE0  // Waveform select
+	RegFourOp           = 0x104 // 4-op enables (OPL3)
+	RegOPL3             = 0x105 // OPL3 enable (OPL3)
+)
+
+var operatorRegBases = [5]uint32{
+	RegOpFlags, RegOpLevel, RegOpAttackDecay, RegOpSustainRelease, RegOpWaveform,
+}
+
+var channelRegBases = [3]uint32{
+	RegChFreqLow, RegChFreqHigh, RegChFeedback,
+}
+
+// OperatorRegBases returns the base addresses of the operator registers, in the order used by OperatorRegs
+func OperatorRegBases() [5]uint32 {
+	return operatorRegBases
+}
+
+// ChannelRegBases returns the base addresses of the channel registers, in the order used by ChannelRegs
+func ChannelRegBases() [3]uint32 {
+	return channelRegBases
+}
+
+func boolBit(b bool, bit uint8) uint8 {
+	if b {
+		return bit
+	}
+	return 0
+}
+
+// OperatorOffset returns the register offset of operator `op` (0 = modulator, 1 = carrier)
+// of `channel` (0-8) in `bank` (0 or 1)
+// The 3rd and 4th operators of a 4-op channel are the operators of the channel 3 above it
+func OperatorOffset(bank, channel, op uint) (uint32, error) {
+	if bank > 1 {
+		return 0, errors.Wrapf(ErrInvalidBank, "bank %d", bank)
+	}
+	if channel >= 9 {
+		return 0, errors.Wrapf(ErrInvalidChannel, "channel %d", channel)
+	}
+	if op > 1 {
+		return 0, errors.Wrapf(ErrInvalidOperator, "operator %d", op)
+	}
+	//Every group of 3 channels uses 8 slots, the carriers being 3 slots after the modulators
+	slot := (channel/3)*8 + channel%3 + op*3
+	return uint32(bank<<8 | slot), nil
+}
+
+// OperatorRegAddr returns the address of the operator register at `base` (one of OperatorRegBases())
+// for operator `op` of `channel` in `bank`
+func OperatorRegAddr(base uint32, bank, channel, op uint) (uint32, error) {
+	ofs, err := OperatorOffset(bank, channel, op)
+	if err != nil {
+		return 0, err
+	}
+	return base + ofs, nil
+}
+
+// ChannelRegAddr returns the address of the channel register at `base` (one of ChannelRegBases())
+// for `channel` (0-8) in `bank` (0 or 1)
+func ChannelRegAddr(base uint32, bank, channel uint) (uint32, error) {
+	if bank > 1 {
+		return 0, errors.Wrapf(ErrInvalidBank, "bank %d", bank)
+	}
+	if channel >= 9 {
+		return 0, errors.Wrapf(ErrInvalidChannel, "channel %d", channel)
+	}
+	return base + uint32(bank<<8|channel), nil
+}
+
+// DecodeOperatorReg splits an operator register address into its base, bank, channel and operator
+// `ok` is false when `reg` does not address an operator
+func DecodeOperatorReg(reg uint32) (base uint32, bank, channel, op uint, ok bool) {
+	base = reg & 0xe0
+	switch base {
+	case RegOpFlags, RegOpLevel, RegOpAttackDecay, RegOpSustainRelease, RegOpWaveform:
+	default:
+		return 0, 0, 0, 0, false
+	}
+	bank = uint(reg>>8) & 1
+	slot := uint(reg & 0x1f)
+	if slot%8 >= 6 || slot/8 >= 3 {
+		return 0, 0, 0, 0, false
+	}
+	channel = (slot/8)*3 + (slot%8)%3
+	op = (slot % 8) / 3
+	return base, bank, channel, op, true
+}
+
+// registerMapped returns true when `reg` addresses a register, `opl3` enables the second bank of the OPL3
+func registerMapped(reg uint32, opl3 bool) bool {
+	if reg > 0x1ff || (reg >= 0x100 && !opl3) {
+		return false
+	}
+	bank := reg & 0x100
+	switch r := reg & 0xff; {
+	case r < 0x20:
+		if bank != 0 {
+			return r == 0x01 || r == RegFourOp&0xff || r == RegOPL3&0xff
+		}
+		return r == RegWaveSelect || r == RegTimer1 || r == RegTimer2 || r == RegTimerControl || r == RegMode
+	case r < 0xa0, r >= 0xe0:
+		_, _, _, _, ok := DecodeOperatorReg(reg)
+		return ok
+	case r == RegRhythm:
+		return bank == 0
+	case r >= 0xd0:
+		return false
+	default:
+		//Channel registers A0-A8, B0-B8 and C0-C8
+		return (r & 0xf) < 9
+	}
+}
+
+// OperatorRegs is the decoded contents of the registers of a single operator
+type OperatorRegs struct {
+	Tremolo       bool  // 0x20 bit 7
+	Vibrato       bool  // 0x20 bit 6
+	Sustain       bool  // 0x20 bit 5, hold the sustain level until key-off
+	KSR           bool  // 0x20 bit 4, key scale envelope rate
+	Multiplier    uint8 // 0x20 bits 0-3
+	KeyScaleLevel uint8 // 0x40 bits 6-7
+	TotalLevel    uint8 // 0x40 bits 0-5, attenuation in 0.75dB steps
+	AttackRate    uint8 // 0x60 bits 4-7
+	DecayRate     uint8 // 0x60 bits 0-3
+	SustainLevel  uint8 // 0x80 bits 4-7
+	ReleaseRate   uint8 // 0x80 bits 0-3
+	Waveform      uint8 // 0xE0 bits 0-2
+}
+
+// Encode returns the register values in the order of OperatorRegBases()
+func (r OperatorRegs) Encode() [5]uint8 {
+	return [5]uint8{
+		boolBit(r.Tremolo, 0x80) | boolBit(r.Vibrato, 0x40) | boolBit(r.Sustain, 0x20) | boolBit(r.KSR, 0x10) | (r.Multiplier & 0x0f),
+		(r.KeyScaleLevel&0x03)<<6 | (r.TotalLevel & 0x3f),
+		(r.AttackRate&0x0f)<<4 | (r.DecayRate & 0x0f),
+		(r.SustainLevel&0x0f)<<4 | (r.ReleaseRate & 0x0f),
+		r.Waveform & 0x07,
+	}
+}
+
+// Decode fills the operator registers from values in the order of OperatorRegBases()
+func (r *OperatorRegs) Decode(regs [5]uint8) {
+	r.Tremolo = (regs[0] & 0x80) != 0
+	r.Vibrato = (regs[0] & 0x40) != 0
+	r.Sustain = (regs[0] & 0x20) != 0
+	r.KSR = (regs[0] & 0x10) != 0
+	r.Multiplier = regs[0] & 0x0f
+	r.KeyScaleLevel = regs[1] >> 6
+	r.TotalLevel = regs[1] & 0x3f
+	r.AttackRate = regs[2] >> 4
+	r.DecayRate = regs[2] & 0x0f
+	r.SustainLevel = regs[3] >> 4
+	r.ReleaseRate = regs[3] & 0x0f
+	r.Waveform = regs[4] & 0x07
+}
+
+// WriteTo writes the operator registers to operator `op` of `channel` in `bank` of `e`
+func (r OperatorRegs) WriteTo(e Emulator, bank, channel, op uint) error {
+	ofs, err := OperatorOffset(bank, channel, op)
+	if err != nil {
+		return err
+	}
+	for i, val := range r.Encode() {
+		e.WriteReg(operatorRegBases[i]+ofs, val)
+	}
+	return nil
+}
+
+// ReadFrom fills the operator registers from the values last written to operator `op` of `channel` in `bank` of `e`
+func (r *OperatorRegs) ReadFrom(e Emulator, bank, channel, op uint) error {
+	ofs, err := OperatorOffset(bank, channel, op)
+	if err != nil {
+		return err
+	}
+	var regs [5]uint8
+	for i, base := range operatorRegBases {
+		regs[i] = e.ReadReg(base + ofs)
+	}
+	r.Decode(regs)
+	return nil
+}
+
+// ChannelRegs is the decoded contents of the registers of a single channel
+type ChannelRegs struct {
+	FNum     uint16 // 0xA0 bits 0-7 and 0xB0 bits 0-1
+	Block    uint8  // 0xB0 bits 2-4
+	KeyOn    bool   // 0xB0 bit 5
+	OutputD  bool   // 0xC0 bit 7 (OPL3)
+	OutputC  bool   // 0xC0 bit 6 (OPL3)
+	Right    bool   // 0xC0 bit 5, output B (OPL3)
+	Left     bool   // 0xC0 bit 4, output A (OPL3)
+	Feedback uint8  // 0xC0 bits 1-3
+	Additive bool   // 0xC0 bit 0, operators are summed instead of modulating each other
+}
+
+// Encode returns the register values in the order of ChannelRegBases()
+func (r ChannelRegs) Encode() [3]uint8 {
+	return [3]uint8{
+		uint8(r.FNum),
+		boolBit(r.KeyOn, 0x20) | (r.Block&0x07)<<2 | uint8(r.FNum>>8)&0x03,
+		boolBit(r.OutputD, 0x80) | boolBit(r.OutputC, 0x40) | boolBit(r.Right, 0x20) | boolBit(r.Left, 0x10) | (r.Feedback&0x07)<<1 | boolBit(r.Additive, 0x01),
+	}
+}
+
+// Decode fills the channel registers from values in the order of ChannelRegBases()
+func (r *ChannelRegs) Decode(regs [3]uint8) {
+	r.FNum = uint16(regs[0]) | uint16(regs[1]&0x03)<<8
+	r.Block = (regs[1] >> 2) & 0x07
+	r.KeyOn = (regs[1] & 0x20) != 0
+	r.OutputD = (regs[2] & 0x80) != 0
+	r.OutputC = (regs[2] & 0x40) != 0
+	r.Right = (regs[2] & 0x20) != 0
+	r.Left = (regs[2] & 0x10) != 0
+	r.Feedback = (regs[2] >> 1) & 0x07
+	r.Additive = (regs[2] & 0x01) != 0
+}
+
+// WriteTo writes the channel registers to `channel` in `bank` of `e`
+// The key-on register is written last, so the new frequency is used by the note
+func (r ChannelRegs) WriteTo(e Emulator, bank, channel uint) error {
+	regs := r.Encode()
+	for _, i := range [3]int{0, 2, 1} {
+		reg, err := ChannelRegAddr(channelRegBases[i], bank, channel)
+		if err != nil {
+			return err
+		}
+		e.WriteReg(reg, regs[i])
+	}
+	return nil
+}
+
+// ReadFrom fills the channel registers from the values last written to `channel` in `bank` of `e`
+func (r *ChannelRegs) ReadFrom(e Emulator, bank, channel uint) error {
+	var regs [3]uint8
+	for i, base := range channelRegBases {
+		reg, err := ChannelRegAddr(base, bank, channel)
+		if err != nil {
+			return err
+		}
+		regs[i] = e.ReadReg(reg)
+	}
+	r.Decode(regs)
+	return nil
+}
+
+// RhythmReg is the decoded contents of register 0xBD
+type RhythmReg struct {
+	TremoloDepth bool // bit 7, 4.8dB instead of 1dB
+	VibratoDepth bool // bit 6, 14 cents instead of 7 cents
+	Rhythm       bool // bit 5, channels 6-8 play percussion
+	BassDrum     bool // bit 4
+	SnareDrum    bool // bit 3
+	TomTom       bool // bit 2
+	Cymbal       bool // bit 1
+	HiHat        bool // bit 0
+}
+
+// Encode returns the register value
+func (r RhythmReg) Encode() uint8 {
+	return boolBit(r.TremoloDepth, 0x80) | boolBit(r.VibratoDepth, 0x40) | boolBit(r.Rhythm, 0x20) |
+		boolBit(r.BassDrum, 0x10) | boolBit(r.SnareDrum, 0x08) | boolBit(r.TomTom, 0x04) |
+		boolBit(r.Cymbal, 0x02) | boolBit(r.HiHat, 0x01)
+}
+
+// Decode fills the rhythm register from its value
+func (r *RhythmReg) Decode(val uint8) {
+	r.TremoloDepth = (val & 0x80) != 0
+	r.VibratoDepth = (val & 0x40) != 0
+	r.Rhythm = (val & 0x20) != 0
+	r.BassDrum = (val & 0x10) != 0
+	r.SnareDrum = (val & 0x08) != 0
+	r.TomTom = (val & 0x04) != 0
+	r.Cymbal = (val & 0x02) != 0
+	r.HiHat = (val & 0x01) != 0
+}
+
+// TimerControlReg is the decoded contents of register 0x04
+type TimerControlReg struct {
+	IRQReset    bool // bit 7, clears the status flags, all other bits are ignored
+	MaskTimer1  bool // bit 6
+	MaskTimer2  bool // bit 5
+	StartTimer2 bool // bit 1
+	StartTimer1 bool // bit 0
+}
+
+// Encode returns the register value
+func (r TimerControlReg) Encode() uint8 {
+	return boolBit(r.IRQReset, 0x80) | boolBit(r.MaskTimer1, 0x40) | boolBit(r.MaskTimer2, 0x20) |
+		boolBit(r.StartTimer2, 0x02) | boolBit(r.StartTimer1, 0x01)
+}
+
+// Decode fills the timer control register from its value
+func (r *TimerControlReg) Decode(val uint8) {
+	r.IRQReset = (val & 0x80) != 0
+	r.MaskTimer1 = (val & 0x40) != 0
+	r.MaskTimer2 = (val & 0x20) != 0
+	r.StartTimer2 = (val & 0x02) != 0
+	r.StartTimer1 = (val & 0x01) != 0
+}
+
+// ModeReg is the decoded contents of register 0x08
+type ModeReg struct {
+	CSW     bool // bit 7, composite sine wave speech synthesis mode
+	NoteSel bool // bit 6, keyboard split point
+}
+
+// Encode returns the register value
+func (r ModeReg) Encode() uint8 {
+	return boolBit(r.CSW, 0x80) | boolBit(r.NoteSel, 0x40)
+}
+
+// Decode fills the mode register from its value
+func (r *ModeReg) Decode(val uint8) {
+	r.CSW = (val & 0x80) != 0
+	r.NoteSel = (val & 0x40) != 0
+}
+
+// WaveSelectReg is the decoded contents of register 0x01
+type WaveSelectReg struct {
+	Enable bool // bit 5, allow waveforms other than sine on an OPL2
+}
+
+// Encode returns the register value
+func (r WaveSelectReg) Encode() uint8 {
+	return boolBit(r.Enable, 0x20)
+}
+
+// Decode fills the waveform select register from its value
+func (r *WaveSelectReg) Decode(val uint8) {
+	r.Enable = (val & 0x20) != 0
+}
+
+// FourOpReg is the decoded contents of register 0x104
+// Pairs 0-2 join channels 0-2 with channels 3-5 of bank 0, pairs 3-5 do the same for bank 1
+type FourOpReg struct {
+	Enable [6]bool
+}
+
+// Encode returns the register value
+func (r FourOpReg) Encode() uint8 {
+	var val uint8
+	for i, on := range r.Enable {
+		val |= boolBit(on, 1<<uint(i))
+	}
+	return val
+}
+
+// Decode fills the 4-op register from its value
+func (r *FourOpReg) Decode(val uint8) {
+	for i := range r.Enable {
+		r.Enable[i] = (val & (1 << uint(i))) != 0
+	}
+}
+
+// OPL3Reg is the decoded contents of register 0x105
+type OPL3Reg struct {
+	New bool // bit 0, enables the OPL3 features
+}
+
+// Encode returns the register value
+func (r OPL3Reg) Encode() uint8 {
+	return boolBit(r.New, 0x01)
+}
+
+// Decode fills the OPL3 register from its value
+func (r *OPL3Reg) Decode(val uint8) {
+	r.New = (val & 0x01) != 0
+}
@@ -0,0 +1,94 @@
+package opl2_test
+
+import (
+	"testing"
+
+	"github.com/gotracker/opl2"
+	"github.com/pkg/errors"
+)
+
+func TestOperatorRegAddr(t *testing.T) {
+	tests := []struct {
+		base              uint32
+		bank, channel, op uint
+		expected          uint32
+	}{
+		{opl2.RegOpFlags, 0, 0, 0, 0x20},
+		{opl2.RegOpFlags, 0, 0, 1, 0x23},
+		{opl2.RegOpLevel, 0, 3, 0, 0x48},
+		{opl2.RegOpLevel, 0, 5, 1, 0x4D},
+		{opl2.RegOpAttackDecay, 0, 6, 0, 0x70},
+		{opl2.RegOpSustainRelease, 1, 8, 1, 0x195},
+		{opl2.RegOpWaveform, 1, 2, 0, 0x1E2},
+	}
+	for _, tt := range tests {
+		reg, err := opl2.OperatorRegAddr(tt.base, tt.bank, tt.channel, tt.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg != tt.expected {
+			t.Errorf("bank %d channel %d op %d: expected %0.3X, got %0.3X", tt.bank, tt.channel, tt.op, tt.expected, reg)
+		}
+
+		base, bank, channel, op, ok := opl2.DecodeOperatorReg(reg)
+		if !ok || base != tt.base || bank != tt.bank || channel != tt.channel || op != tt.op {
+			t.Errorf("%0.3X: decoded as base %0.2X bank %d channel %d op %d", reg, base, bank, channel, op)
+		}
+	}
+
+	if _, err := opl2.OperatorRegAddr(opl2.RegOpFlags, 0, 9, 0); !errors.Is(err, opl2.ErrInvalidChannel) {
+		t.Errorf("expected an invalid channel error, got %v", err)
+	}
+	if _, _, _, _, ok := opl2.DecodeOperatorReg(0x26); ok {
+		t.Error("expected 0x26 not to address an operator")
+	}
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	op := opl2.OperatorRegs{
+		Tremolo:       true,
+		Sustain:       true,
+		Multiplier:    7,
+		KeyScaleLevel: 2,
+		TotalLevel:    0x2A,
+		AttackRate:    15,
+		DecayRate:     3,
+		SustainLevel:  9,
+		ReleaseRate:   4,
+		Waveform:      5,
+	}
+	if enc := op.Encode(); enc != [5]uint8{0xA7, 0xAA, 0xF3, 0x94, 0x05} {
+		t.Errorf("unexpected operator encoding % X", enc)
+	}
+	var opDec opl2.OperatorRegs
+	opDec.Decode(op.Encode())
+	if opDec != op {
+		t.Errorf("operator registers did not round trip: %+v", opDec)
+	}
+
+	ch := opl2.ChannelRegs{
+		FNum:     0x2AE,
+		Block:    4,
+		KeyOn:    true,
+		Left:     true,
+		OutputD:  true,
+		Feedback: 6,
+	}
+	if enc := ch.Encode(); enc != [3]uint8{0xAE, 0x32, 0x9C} {
+		t.Errorf("unexpected channel encoding % X", enc)
+	}
+	var chDec opl2.ChannelRegs
+	chDec.Decode(ch.Encode())
+	if chDec != ch {
+		t.Errorf("channel registers did not round trip: %+v", chDec)
+	}
+
+	var bd opl2.RhythmReg
+	bd.Decode(0xB5)
+	if !bd.TremoloDepth || bd.VibratoDepth || !bd.Rhythm || !bd.BassDrum || !bd.TomTom || !bd.HiHat || bd.SnareDrum || bd.Cymbal {
+		t.Errorf("unexpected rhythm decoding %+v", bd)
+	}
+	if enc := bd.Encode(); enc != 0xB5 {
+		t.Errorf("expected rhythm encoding B5, got %0.2X", enc)
+	}
+}
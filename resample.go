@@ -0,0 +1,155 @@
+package opl2
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// ResampleQuality selects how Opal converts its native output to the output sample rate
+type ResampleQuality int
+
+const (
+	// ResampleLinear interpolates linearly between native samples, the cheapest mode and the default
+	// It lets through aliases of the frequencies above half the output rate and dulls the highs a little
+	ResampleLinear = ResampleQuality(iota)
+	// ResampleSincLow uses a windowed sinc filter with 8 taps
+	ResampleSincLow
+	// ResampleSincMedium uses a windowed sinc filter with 16 taps
+	ResampleSincMedium
+	// ResampleSincHigh uses a windowed sinc filter with 32 taps, the best quality at 4 times the cost of ResampleSincLow
+	ResampleSincHigh
+)
+
+const (
+	//Amount of filter phases between two native samples, the coefficients are interpolated between them
+	sincPhases = 256
+)
+
+// sincQuality holds the amount of taps and the part of the passband kept by each sinc quality
+var sincQuality = map[ResampleQuality]struct {
+	taps    int
+	rolloff float64
+}{
+	ResampleSincLow:    {8, 0.80},
+	ResampleSincMedium: {16, 0.88},
+	ResampleSincHigh:   {32, 0.94},
+}
+
+// sincResampler is a polyphase windowed sinc filter that resamples a stereo stream
+// The output lags the input by half the taps, so the filter only looks at native samples that are already known
+type sincResampler struct {
+	taps  int
+	coefs []float32 //(sincPhases+1) rows of taps coefficients, a row for every fraction of a native sample
+	//History of the last taps native samples, stored twice so the window is contiguous
+	hist [2][]float32
+	pos  int
+}
+
+// newSincResampler creates a resampler of `quality` from `nativeRate` to `rate` Hz
+func newSincResampler(quality ResampleQuality, nativeRate, rate float64) *sincResampler {
+	q := sincQuality[quality]
+	r := &sincResampler{
+		taps:  q.taps,
+		coefs: make([]float32, (sincPhases+1)*q.taps),
+	}
+	for i := range r.hist {
+		r.hist[i] = make([]float32, 2*q.taps)
+	}
+
+	//Cutoff in cycles per native sample, below the nyquist frequency of the lower of both rates
+	cutoff := 0.5 * q.rolloff
+	if rate < nativeRate {
+		cutoff *= rate / nativeRate
+	}
+	half := float64(q.taps / 2)
+	for p := 0; p <= sincPhases; p++ {
+		frac := float64(p) / sincPhases
+		row := r.coefs[p*q.taps : (p+1)*q.taps]
+		sum := 0.0
+		h := make([]float64, q.taps)
+		for j := range h {
+			//Distance of tap j, from the oldest to the newest sample, to the output position
+			d := half - 1 + frac - float64(j)
+			x := 2 * cutoff * d
+			sinc := 1.0
+			if x != 0 {
+				sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+			}
+			//Blackman window
+			u := d / half
+			w := 0.42 + 0.5*math.Cos(math.Pi*u) + 0.08*math.Cos(2*math.Pi*u)
+			h[j] = sinc * w
+			sum += h[j]
+		}
+		//Unity gain at DC for every phase
+		for j := range row {
+			row[j] = float32(h[j] / sum)
+		}
+	}
+	return r
+}
+
+// push adds the next native sample to the history
+func (r *sincResampler) push(l, rr int16) {
+	r.hist[0][r.pos] = float32(l)
+	r.hist[0][r.pos+r.taps] = float32(l)
+	r.hist[1][r.pos] = float32(rr)
+	r.hist[1][r.pos+r.taps] = float32(rr)
+	r.pos++
+	if r.pos == r.taps {
+		r.pos = 0
+	}
+}
+
+// sample returns the output sample `frac` native samples past the middle of the history
+func (r *sincResampler) sample(frac float64) (int16, int16) {
+	ph := frac * sincPhases
+	p := int(ph)
+	if p >= sincPhases {
+		p = sincPhases - 1
+	}
+	t := float32(ph - float64(p))
+	c0 := r.coefs[p*r.taps : (p+1)*r.taps]
+	c1 := r.coefs[(p+1)*r.taps : (p+2)*r.taps]
+	hl := r.hist[0][r.pos : r.pos+r.taps]
+	hr := r.hist[1][r.pos : r.pos+r.taps]
+	var l, rr float32
+	for j, c := range c0 {
+		c += t * (c1[j] - c)
+		l += hl[j] * c
+		rr += hr[j] * c
+	}
+	return clampSample(l), clampSample(rr)
+}
+
+// clampSample rounds and clamps a filtered sample to 16 bits
+func clampSample(s float32) int16 {
+	switch {
+	case s <= -0x8000:
+		return -0x8000
+	case s >= 0x7FFF:
+		return 0x7FFF
+	}
+	return int16(math.Round(float64(s)))
+}
+
+// SetResampleQuality selects the conversion of the native output to the output sample rate, see ResampleQuality
+// The quality is kept by Reset
+func (o *Opal) SetResampleQuality(quality ResampleQuality) error {
+	if _, ok := sincQuality[quality]; !ok && quality != ResampleLinear {
+		return errors.Wrapf(ErrUnsupportedOption, "resample quality %d", quality)
+	}
+	o.Quality = quality
+	o.setupResampler()
+	return nil
+}
+
+// setupResampler builds the sinc filter for the current quality and rates, with an empty history
+func (o *Opal) setupResampler() {
+	o.resampler = nil
+	if o.Quality == ResampleLinear {
+		return
+	}
+	o.resampler = newSincResampler(o.Quality, float64(o.MasterClock)/OPL3ClockDivider, float64(o.SampleRate))
+}
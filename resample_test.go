@@ -0,0 +1,69 @@
+package opl2_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/gotracker/opl2"
+	"github.com/pkg/errors"
+)
+
+func TestOpalResampleQuality(t *testing.T) {
+	const rate = 22050
+	// An 18kHz tone is above half the output rate, what's left of it after resampling is aliasing
+	rms := func(quality opl2.ResampleQuality) float64 {
+		o := opl2.NewOpal(rate)
+		if err := o.SetResampleQuality(quality); err != nil {
+			t.Fatal(err)
+		}
+		playTone(o, 0x00)
+		o.WriteReg(0x23, 0x2A) // carrier: sustain, multiplier 10
+		o.WriteReg(0xA0, 0x29)
+		o.WriteReg(0xB0, 0x3D) // key on, block 7, F-number 0x129
+		out := make([]int32, rate/4)
+		o.GenerateBlock2(uint(len(out)), out)
+		sum := 0.0
+		for _, s := range out {
+			sum += float64(s) * float64(s)
+		}
+		return math.Sqrt(sum / float64(len(out)))
+	}
+
+	linear := rms(opl2.ResampleLinear)
+	for _, quality := range []opl2.ResampleQuality{opl2.ResampleSincLow, opl2.ResampleSincMedium, opl2.ResampleSincHigh} {
+		if sinc := rms(quality); sinc*10 > linear {
+			t.Errorf("quality %d: expected the aliasing to drop by 20dB, got %.1f against %.1f with linear interpolation", quality, sinc, linear)
+		}
+	}
+
+	if err := opl2.NewOpal(rate).SetResampleQuality(opl2.ResampleQuality(-1)); !errors.Is(err, opl2.ErrUnsupportedOption) {
+		t.Errorf("expected ErrUnsupportedOption for an unknown quality, got %v", err)
+	}
+}
+
+func TestOpalResamplePassband(t *testing.T) {
+	// A tone well below half the output rate keeps its level with every quality
+	peak := func(quality opl2.ResampleQuality) int32 {
+		o := opl2.NewOpal(44100)
+		if err := o.SetResampleQuality(quality); err != nil {
+			t.Fatal(err)
+		}
+		playTone(o, 0x00)
+		out := make([]int32, 4096)
+		o.GenerateBlock2(uint(len(out)), out)
+		p := int32(0)
+		for _, s := range out {
+			if s > p {
+				p = s
+			}
+		}
+		return p
+	}
+
+	linear := peak(opl2.ResampleLinear)
+	for _, quality := range []opl2.ResampleQuality{opl2.ResampleSincLow, opl2.ResampleSincMedium, opl2.ResampleSincHigh} {
+		if p := peak(quality); p < linear*98/100 || p > linear*102/100 {
+			t.Errorf("quality %d: expected a peak of about %d, got %d", quality, linear, p)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package opl2
+
+import "math"
+
+// IRQHandler is called when a timer overflow raises the IRQ of a chip, with the value of its status register
+// It runs in the middle of a GenerateBlock call, right after the sample where the overflow happens,
+// so register writes made by the handler take effect from the next sample on
+type IRQHandler func(status uint8)
+
+const (
+	//Ticks per second of timer 1 and timer 2 at the nominal clock (80µs and 320µs)
+	timer1TickRate = 12500
+	timer2TickRate = 3125
+
+	//Flags of the status register
+	statusIRQ    = 0x80
+	statusTimer1 = 0x40
+	statusTimer2 = 0x20
+	//Unused low bits of the status register that read as set on the YM3526 and YM3812
+	statusOPL2Bits = 0x06
+)
+
+// timer is one of the two 8-bit interval timers of the chip
+// The progress within a tick is kept as an integer fraction, so the timer stays sample accurate
+// at any sample rate and clock: every sample adds `step` to `acc` and a tick takes `period`
+type timer struct {
+	step    uint64
+	period  uint64
+	acc     uint64
+	counter uint8
+	reload  uint8
+	running bool
+	masked  bool
+	flag    uint8
+}
+
+// setRate sets up the timer for output at `rate` Hz from a chip running at `clock` Hz,
+// where `tickRate` is the amount of ticks per second at the nominal clock `refClock`
+// The progress within the current tick is kept
+func (t *timer) setRate(rate, clock, refClock uint32, tickRate uint64) {
+	period := uint64(rate) * uint64(refClock)
+	if t.period != 0 {
+		t.acc = uint64(float64(t.acc) * float64(period) / float64(t.period))
+		if t.acc >= period {
+			t.acc = period - 1
+		}
+	}
+	t.step = tickRate * uint64(clock)
+	t.period = period
+}
+
+// start loads the counter from the reload value and starts counting, a running timer is left alone
+func (t *timer) start() {
+	if t.running {
+		return
+	}
+	t.running = true
+	t.counter = t.reload
+	t.acc = 0
+}
+
+// samplesUntilOverflow returns the amount of samples until the timer overflows, counting the overflowing sample
+func (t *timer) samplesUntilOverflow() uint32 {
+	if !t.running || t.step == 0 {
+		return math.MaxUint32
+	}
+	need := uint64(256-uint32(t.counter))*t.period - t.acc
+	n := (need + t.step - 1) / t.step
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// advance runs the timer for `samples` samples and returns the amount of overflows
+// Every overflow reloads the counter
+func (t *timer) advance(samples uint32) uint32 {
+	if !t.running || t.period == 0 {
+		return 0
+	}
+	overflows := uint32(0)
+	t.acc += uint64(samples) * t.step
+	ticks := t.acc / t.period
+	t.acc %= t.period
+	for ticks > 0 {
+		left := uint64(256 - uint32(t.counter))
+		if ticks < left {
+			t.counter += uint8(ticks)
+			break
+		}
+		ticks -= left
+		t.counter = t.reload
+		overflows++
+	}
+	return overflows
+}
+
+// timers are the two interval timers of the chip together with the flags they raise in the status register
+type timers struct {
+	t      [2]timer
+	status uint8
+}
+
+// setRate sets up both timers for output at `rate` Hz from a chip running at `clock` Hz
+func (ts *timers) setRate(rate, clock, refClock uint32) {
+	ts.t[0].setRate(rate, clock, refClock, timer1TickRate)
+	ts.t[1].setRate(rate, clock, refClock, timer2TickRate)
+}
+
+// reset stops both timers and clears their registers and flags, keeping the rate
+func (ts *timers) reset() {
+	for i := range ts.t {
+		t := &ts.t[i]
+		*t = timer{step: t.step, period: t.period}
+	}
+	ts.t[0].flag = statusTimer1
+	ts.t[1].flag = statusTimer2
+	ts.status = 0
+}
+
+// write handles a write to one of the timer registers 0x02-0x04
+func (ts *timers) write(reg uint32, val uint8) {
+	switch reg {
+	case 0x02:
+		ts.t[0].reload = val
+	case 0x03:
+		ts.t[1].reload = val
+	case 0x04:
+		if (val & 0x80) != 0 {
+			//IRQ reset clears all flags and leaves the rest of the register alone
+			ts.status = 0
+			return
+		}
+		ts.t[0].masked = (val & 0x40) != 0
+		ts.t[1].masked = (val & 0x20) != 0
+		for i := range ts.t {
+			if (val & (1 << uint(i))) != 0 {
+				ts.t[i].start()
+			} else {
+				ts.t[i].running = false
+			}
+		}
+	}
+}
+
+// samplesUntilOverflow returns the amount of samples until the first overflow of either timer
+func (ts *timers) samplesUntilOverflow() uint32 {
+	n := ts.t[0].samplesUntilOverflow()
+	if m := ts.t[1].samplesUntilOverflow(); m < n {
+		n = m
+	}
+	return n
+}
+
+// advance runs both timers for `samples` samples and returns the flags of the timers that overflowed,
+// whether masked or not, and whether an unmasked overflow raised the IRQ
+func (ts *timers) advance(samples uint32) (overflowed uint8, irq bool) {
+	for i := range ts.t {
+		t := &ts.t[i]
+		if t.advance(samples) == 0 {
+			continue
+		}
+		overflowed |= t.flag
+		if !t.masked {
+			ts.status |= statusIRQ | t.flag
+			irq = true
+		}
+	}
+	return overflowed, irq
+}
@@ -0,0 +1,109 @@
+package opl2_test
+
+import (
+	"testing"
+
+	"github.com/gotracker/opl2"
+)
+
+func TestTimerIRQ(t *testing.T) {
+	var (
+		pos   uint
+		irqs  []uint
+		state uint8
+	)
+	c, err := opl2.NewChip(44100, opl2.WithOnIRQ(func(status uint8) {
+		irqs = append(irqs, pos)
+		state = status
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 256 ticks of 80µs overflow after 903.168 samples
+	c.WriteReg(0x02, 0x00)
+	c.WriteReg(0x04, 0x01)
+	for pos = 1; pos <= 2000; pos++ {
+		c.GenerateBlock2(1, nil)
+	}
+	if len(irqs) != 2 || irqs[0] != 904 || irqs[1] != 1807 {
+		t.Fatalf("expected IRQs at samples 904 and 1807, got %v", irqs)
+	}
+	if state&0xE0 != 0xC0 {
+		t.Errorf("expected the timer 1 flags in the status, got %0.2X", state)
+	}
+
+	// the same timing with a single block
+	irqs = nil
+	c.Reset()
+	c.WriteReg(0x04, 0x01)
+	c.GenerateBlock2(2000, make([]int32, 2000))
+	if len(irqs) != 2 {
+		t.Fatalf("expected 2 IRQs in a single block, got %d", len(irqs))
+	}
+
+	c.WriteReg(0x04, 0x80)
+	if status := c.ReadStatus(); status&0xE0 != 0 {
+		t.Errorf("expected the IRQ reset to clear the flags, got %0.2X", status)
+	}
+
+	// a masked timer keeps running without raising its flag
+	c.WriteReg(0x03, 0xFF)
+	c.WriteReg(0x04, 0x43)
+	c.GenerateBlock2(2000, nil)
+	if status := c.ReadStatus(); status&0xE0 != 0xA0 {
+		t.Errorf("expected only the timer 2 flags to be raised, got %0.2X", status)
+	}
+}
+
+func TestCompositeSineWaveMode(t *testing.T) {
+	run := func(model opl2.Model, reg08 uint8) bool {
+		c := newChip(t, model)
+		playTone(c, 0x30)
+		c.WriteReg(0xB0, 0x11) // key off, block 4
+		c.WriteReg(0x83, 0x00) // carrier: slowest release
+		c.WriteReg(0x08, reg08)
+		c.WriteReg(0x02, 0xFF)
+		c.WriteReg(0x04, 0x41) // timer 1 running, but masked
+		out := make([]int32, 1024)
+		c.GenerateBlock2(uint(len(out)), out)
+		return !isSilent(out)
+	}
+
+	if !run(opl2.ModelYM3812, 0x80) {
+		t.Error("expected the timer 1 overflow to key on the channels")
+	}
+	if run(opl2.ModelYM3812, 0x00) {
+		t.Error("expected silence without the CSW bit")
+	}
+	if run(opl2.ModelYMF262, 0x80) {
+		t.Error("expected the YMF262 to ignore the CSW bit")
+	}
+}
+
+func TestOpalTimerIRQ(t *testing.T) {
+	var irqs []uint
+	o := opl2.NewOpal(44100)
+	pos := uint(0)
+	o.SetOnIRQ(func(status uint8) {
+		irqs = append(irqs, pos)
+	})
+
+	// the same timing as the timers of Chip
+	o.WriteReg(0x02, 0x00)
+	o.WriteReg(0x04, 0x01)
+	out := make([]int32, 1)
+	for pos = 1; pos <= 2000; pos++ {
+		o.GenerateBlock2(1, out)
+	}
+	if len(irqs) != 2 || irqs[0] != 904 || irqs[1] != 1807 {
+		t.Fatalf("expected IRQs at samples 904 and 1807, got %v", irqs)
+	}
+	if status := o.ReadStatus(); status != 0xC0 {
+		t.Errorf("expected the timer 1 flags in the status, got %0.2X", status)
+	}
+	o.WriteReg(0x04, 0x80)
+	if status := o.ReadStatus(); status != 0x00 {
+		t.Errorf("expected the IRQ reset to clear the flags, got %0.2X", status)
+	}
+}